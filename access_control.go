@@ -0,0 +1,90 @@
+package knet
+
+import (
+	"net"
+	"sync"
+)
+
+// AccessControl decides which remote addresses may connect. A connection
+// is refused if its address is in a denied network, if an allowlist is set
+// and the address is not in it, or if the check callback returns false.
+// Addresses without an IP, e.g. unix sockets, are only subject to the
+// callback. The lists can be updated while the server is running.
+type AccessControl struct {
+	sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	check func(remote net.Addr) bool
+}
+
+func NewAccessControl() *AccessControl {
+	return &AccessControl{}
+}
+
+// SetAllow replaces the allowlist, an empty list allows every address not
+// denied.
+func (ac *AccessControl) SetAllow(nets []*net.IPNet) {
+	ac.Lock()
+	ac.allow = nets
+	ac.Unlock()
+}
+
+// SetDeny replaces the denylist.
+func (ac *AccessControl) SetDeny(nets []*net.IPNet) {
+	ac.Lock()
+	ac.deny = nets
+	ac.Unlock()
+}
+
+// SetAllowCIDRs replaces the allowlist with the parsed CIDRs or IPs.
+func (ac *AccessControl) SetAllowCIDRs(cidrs ...string) error {
+	nets, err := ParseCIDRs(cidrs...)
+	if err != nil {
+		return err
+	}
+	ac.SetAllow(nets)
+	return nil
+}
+
+// SetDenyCIDRs replaces the denylist with the parsed CIDRs or IPs.
+func (ac *AccessControl) SetDenyCIDRs(cidrs ...string) error {
+	nets, err := ParseCIDRs(cidrs...)
+	if err != nil {
+		return err
+	}
+	ac.SetDeny(nets)
+	return nil
+}
+
+// SetCheck sets a callback consulted after the lists, nil removes it.
+func (ac *AccessControl) SetCheck(check func(remote net.Addr) bool) {
+	ac.Lock()
+	ac.check = check
+	ac.Unlock()
+}
+
+func (ac *AccessControl) Allowed(remote net.Addr) bool {
+	ac.RLock()
+	allow, deny, check := ac.allow, ac.deny, ac.check
+	ac.RUnlock()
+
+	if ip := addrIP(remote); ip != nil {
+		if containsIP(deny, ip) {
+			return false
+		}
+		if len(allow) > 0 && !containsIP(allow, ip) {
+			return false
+		}
+	}
+
+	return check == nil || check(remote)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package knet
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessControlAllowed(t *testing.T) {
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234} }
+
+	ac := NewAccessControl()
+	if err := ac.SetAllowCIDRs("10.0.0.0/8", "192.168.1.1", "2001:db8::/32"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.SetDenyCIDRs("10.1.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{tcp("10.0.0.1"), true},
+		{tcp("10.1.2.3"), false},
+		{tcp("192.168.1.1"), true},
+		{tcp("192.168.1.2"), false},
+		{tcp("2001:db8::1"), true},
+		{tcp("2001:db9::1"), false},
+		{&net.UDPAddr{IP: net.ParseIP("10.0.0.1")}, true},
+		{&net.UnixAddr{Name: "/tmp/knet.sock", Net: "unix"}, true},
+		{memAddr("10.1.2.3:80"), false},
+	}
+
+	for _, tt := range tests {
+		if got := ac.Allowed(tt.addr); got != tt.want {
+			t.Errorf("Allowed(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	// the lists can be replaced at any time
+	ac.SetAllow(nil)
+	if err := ac.SetDenyCIDRs("192.168.0.0/16"); err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{"10.1.2.3": true, "172.16.0.1": true, "192.168.1.1": false} {
+		if got := ac.Allowed(tcp(addr)); got != want {
+			t.Errorf("Allowed(%v) = %v after the update, want %v", addr, got, want)
+		}
+	}
+
+	// the check runs after the lists, and alone for addresses without an ip
+	ac.SetCheck(func(remote net.Addr) bool { return remote.Network() != "unix" })
+	if ac.Allowed(&net.UnixAddr{Name: "/tmp/knet.sock", Net: "unix"}) {
+		t.Error("unix address allowed despite the check")
+	}
+	if ac.Allowed(tcp("192.168.1.1")) {
+		t.Error("denied address allowed by the check")
+	}
+	if !ac.Allowed(tcp("10.0.0.1")) {
+		t.Error("address refused by the check")
+	}
+
+	if err := ac.SetAllowCIDRs("10.0.0.0/33"); err == nil {
+		t.Error("invalid cidr accepted")
+	}
+}
+
+func TestServerAccessControl(t *testing.T) {
+	ac := NewAccessControl()
+	if err := ac.SetDenyCIDRs("127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := NewTCPServerConfig()
+	conf.AccessControl = ac
+	srv := NewTCPServer(testContext(t), conf)
+	srv.SetProtocol(testProto{})
+	srv.SetIoHandler(&echoHandler{})
+
+	ln, err := TCPListen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		srv.Serve(ln)
+		close(served)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-served
+		srv.Close()
+	})
+	addr := ln.Addr().String()
+
+	// a denied connection is closed without a session
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read() on a denied connection error = %v, want %v", err, io.EOF)
+	}
+	if stats := srv.Stats(); stats.Denied != 1 {
+		t.Fatalf("%d connections denied, want 1", stats.Denied)
+	}
+
+	ac.SetDeny(nil)
+
+	c := NewTCPClient(testContext(t), NewTCPClientConfig())
+	c.SetProtocol(testProto{})
+	if err = c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	resp, err := c.Call(context.Background(), &testMsg{id: 1, body: "ping"})
+	if err != nil || resp.(*testMsg).body != "ping" {
+		t.Fatalf("Call() = %v, %v once allowed, want the echo", resp, err)
+	}
+	if stats := srv.Stats(); stats.Denied != 1 || stats.Accepted != 2 {
+		t.Fatalf("stats = %+v, want 2 accepted and 1 denied", stats)
+	}
+}
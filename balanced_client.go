@@ -0,0 +1,787 @@
+package knet
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNoEndpoint = errors.New("no endpoint available")
+
+// defaultReconnectInterval is how often dead endpoints are reconnected when
+// no EjectDuration paces it.
+const defaultReconnectInterval = time.Second
+
+// EndpointFactory creates the client of one server address. The client is
+// not connected yet, its user sets the protocol and the handler before
+// dialing addr.
+type EndpointFactory interface {
+	NewClient(addr string) (Client, error)
+}
+
+type EndpointFactoryFunc func(addr string) (Client, error)
+
+func (f EndpointFactoryFunc) NewClient(addr string) (Client, error) {
+	return f(addr)
+}
+
+// HashKeyer is implemented by requests routed by the consistent hash
+// balancer. Requests without a hash key are routed by their id.
+type HashKeyer interface {
+	HashKey() string
+}
+
+type pendingCounter interface {
+	PendingCount() int
+}
+
+type Endpoint struct {
+	Addr string
+
+	clientLock   sync.RWMutex
+	client       Client
+	pending      int64
+	limiter      *Limiter
+	failures     int32
+	ejectedUntil int64
+}
+
+func (ep *Endpoint) Client() (client Client) {
+	ep.clientLock.RLock()
+	client = ep.client
+	ep.clientLock.RUnlock()
+	return
+}
+
+func (ep *Endpoint) setClient(client Client) (old Client) {
+	ep.clientLock.Lock()
+	old, ep.client = ep.client, client
+	ep.clientLock.Unlock()
+	return
+}
+
+// clearClient drops client from the endpoint unless it was replaced already.
+func (ep *Endpoint) clearClient(client Client) (cleared bool) {
+	ep.clientLock.Lock()
+	if cleared = ep.client == client; cleared {
+		ep.client = nil
+	}
+	ep.clientLock.Unlock()
+	return
+}
+
+// Pending returns the number of in-flight requests on the endpoint.
+func (ep *Endpoint) Pending() int {
+	if pc, ok := ep.Client().(pendingCounter); ok {
+		return pc.PendingCount()
+	}
+	return int(atomic.LoadInt64(&ep.pending))
+}
+
+// Limiter returns the concurrency limiter of the endpoint, nil if calls
+// aren't limited.
+func (ep *Endpoint) Limiter() *Limiter {
+	return ep.limiter
+}
+
+func (ep *Endpoint) IsEjected() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&ep.ejectedUntil)
+}
+
+func (ep *Endpoint) IsHealthy() bool {
+	client := ep.Client()
+	return client != nil && client.IsConnected() && !ep.IsEjected()
+}
+
+// Balancer chooses the endpoint serving a request. Update is called with the
+// whole endpoint set whenever it changes. Pick must only return endpoints
+// accepted by available, or nil if there is none.
+type Balancer interface {
+	Update(endpoints []*Endpoint)
+	Pick(req Message, available func(*Endpoint) bool) *Endpoint
+}
+
+type endpointList struct {
+	sync.RWMutex
+	endpoints []*Endpoint
+}
+
+func (l *endpointList) Update(endpoints []*Endpoint) {
+	l.Lock()
+	l.endpoints = endpoints
+	l.Unlock()
+}
+
+func (l *endpointList) list() (endpoints []*Endpoint) {
+	l.RLock()
+	endpoints = l.endpoints
+	l.RUnlock()
+	return
+}
+
+type roundRobinBalancer struct {
+	endpointList
+	next uint64
+}
+
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Pick(req Message, available func(*Endpoint) bool) *Endpoint {
+	endpoints := b.list()
+
+	for i := 0; i < len(endpoints); i++ {
+		ep := endpoints[int(atomic.AddUint64(&b.next, 1)%uint64(len(endpoints)))]
+		if available(ep) {
+			return ep
+		}
+	}
+	return nil
+}
+
+type leastPendingBalancer struct {
+	endpointList
+}
+
+func NewLeastPendingBalancer() Balancer {
+	return &leastPendingBalancer{}
+}
+
+func (b *leastPendingBalancer) Pick(req Message, available func(*Endpoint) bool) (picked *Endpoint) {
+	endpoints := b.list()
+	if len(endpoints) == 0 {
+		return
+	}
+
+	var (
+		start = rand.Intn(len(endpoints))
+		min   int
+	)
+
+	// start at a random offset so ties don't always favor the same endpoint
+	for i := 0; i < len(endpoints); i++ {
+		ep := endpoints[(start+i)%len(endpoints)]
+		if !available(ep) {
+			continue
+		}
+		if pending := ep.Pending(); picked == nil || pending < min {
+			picked, min = ep, pending
+		}
+	}
+	return
+}
+
+type p2cBalancer struct {
+	endpointList
+}
+
+// NewP2CBalancer returns a power of two choices balancer: it picks two
+// endpoints at random and routes to the one with fewer pending requests.
+func NewP2CBalancer() Balancer {
+	return &p2cBalancer{}
+}
+
+func (b *p2cBalancer) Pick(req Message, available func(*Endpoint) bool) *Endpoint {
+	var candidates []*Endpoint
+
+	for _, ep := range b.list() {
+		if available(ep) {
+			candidates = append(candidates, ep)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+
+	if candidates[j].Pending() < candidates[i].Pending() {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+type hashRingNode struct {
+	hash uint64
+	ep   *Endpoint
+}
+
+type consistentHashBalancer struct {
+	sync.RWMutex
+	replicas int
+	ring     []hashRingNode
+}
+
+// NewConsistentHashBalancer returns a balancer routing requests with the
+// same HashKey to the same endpoint, with replicas virtual nodes per endpoint.
+func NewConsistentHashBalancer(replicas int) Balancer {
+	if replicas <= 0 {
+		replicas = 100
+	}
+	return &consistentHashBalancer{replicas: replicas}
+}
+
+func (b *consistentHashBalancer) Update(endpoints []*Endpoint) {
+	ring := make([]hashRingNode, 0, len(endpoints)*b.replicas)
+
+	for _, ep := range endpoints {
+		for i := 0; i < b.replicas; i++ {
+			ring = append(ring, hashRingNode{hash: hashString(ep.Addr + "#" + strconv.Itoa(i)), ep: ep})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	b.Lock()
+	b.ring = ring
+	b.Unlock()
+}
+
+func (b *consistentHashBalancer) Pick(req Message, available func(*Endpoint) bool) *Endpoint {
+	b.RLock()
+	ring := b.ring
+	b.RUnlock()
+
+	if len(ring) == 0 {
+		return nil
+	}
+
+	var key string
+	switch r := req.(type) {
+	case HashKeyer:
+		key = r.HashKey()
+	case Request:
+		key = strconv.FormatUint(r.Id(), 10)
+	}
+
+	var (
+		hash  = hashString(key)
+		start = sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	)
+
+	// walk clockwise past unavailable endpoints
+	for i := 0; i < len(ring); i++ {
+		if node := ring[(start+i)%len(ring)]; available(node.ep) {
+			return node.ep
+		}
+	}
+	return nil
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+type BalancedClientConfig struct {
+	Balancer Balancer
+	// MaxFailures is the number of consecutive failures ejecting an endpoint.
+	MaxFailures int
+	// EjectDuration is how long an ejected endpoint stays out of rotation.
+	// Dead endpoints are reconnected every half of it, or every second if
+	// it is 0.
+	EjectDuration time.Duration
+	// HealthChecker probes every endpoint each HealthCheckInterval, failing
+	// endpoints are ejected and reconnected.
+	HealthChecker       HealthChecker
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	// Breakers, if set, gives every endpoint a circuit breaker, endpoints
+	// with an open breaker are skipped.
+	Breakers *BreakerRegistry
+	// NewLimiter, if set, creates a concurrency limiter for every endpoint.
+	// Calls go to endpoints below their limit first, and wait for a slot
+	// when all are at their limit.
+	NewLimiter func() *Limiter
+	// AllowEmptyUpdate makes Subscribe apply an empty resolver result,
+	// closing every endpoint. By default it is taken for a resolver failure
+	// and ignored.
+	AllowEmptyUpdate bool
+}
+
+func NewBalancedClientConfig() *BalancedClientConfig {
+	return &BalancedClientConfig{
+		Balancer:      NewRoundRobinBalancer(),
+		MaxFailures:   5,
+		EjectDuration: 30 * time.Second,
+	}
+}
+
+// BalancedClient spreads requests over the connections to a set of servers.
+type BalancedClient struct {
+	sync.RWMutex
+	// updateLock serializes SetEndpoints
+	updateLock sync.Mutex
+	conf       *BalancedClientConfig
+	factory    EndpointFactory
+	endpoints  []*Endpoint
+	protocol   Protocol
+	handler    IoHandler
+	closed     bool
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+func NewBalancedClient(ctx context.Context, factory EndpointFactory, conf *BalancedClientConfig) *BalancedClient {
+	newctx, cancel := context.WithCancel(ctx)
+
+	if conf.Balancer == nil {
+		conf.Balancer = NewRoundRobinBalancer()
+	}
+
+	c := &BalancedClient{
+		conf:    conf,
+		factory: factory,
+		ctx:     newctx,
+		cancel:  cancel,
+	}
+
+	go c.maintainLoop()
+
+	if conf.HealthCheckInterval > 0 {
+		go c.healthCheckLoop()
+	}
+	return c
+}
+
+// Dial connects to a comma separated list of addresses.
+func (c *BalancedClient) Dial(addr string) error {
+	var addrs []string
+	for _, a := range strings.Split(addr, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return c.SetEndpoints(addrs)
+}
+
+// SetEndpoints replaces the endpoint set, connecting to the new addresses and
+// closing the connections to the removed ones. It returns ErrNoEndpoint if
+// none of the endpoints could be connected.
+func (c *BalancedClient) SetEndpoints(addrs []string) error {
+	if c.IsClosed() {
+		return ErrClientClosed
+	}
+
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	c.RLock()
+	current := make(map[string]*Endpoint, len(c.endpoints))
+	for _, ep := range c.endpoints {
+		current[ep.Addr] = ep
+	}
+	c.RUnlock()
+
+	var (
+		endpoints = make([]*Endpoint, 0, len(addrs))
+		added     []*Endpoint
+		seen      = make(map[string]bool, len(addrs))
+	)
+
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		if ep, ok := current[addr]; ok {
+			endpoints = append(endpoints, ep)
+			delete(current, addr)
+			continue
+		}
+
+		ep := &Endpoint{Addr: addr}
+		if c.conf.NewLimiter != nil {
+			ep.limiter = c.conf.NewLimiter()
+		}
+		endpoints = append(endpoints, ep)
+		added = append(added, ep)
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Addr < endpoints[j].Addr })
+
+	for _, ep := range added {
+		c.connect(ep)
+	}
+
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		for _, ep := range added {
+			closeEndpoint(ep)
+		}
+		return ErrClientClosed
+	}
+	c.endpoints = endpoints
+	c.conf.Balancer.Update(endpoints)
+	c.Unlock()
+
+	for _, ep := range current {
+		closeEndpoint(ep)
+		if c.conf.Breakers != nil {
+			c.conf.Breakers.Remove(ep.Addr)
+		}
+	}
+
+	for _, ep := range endpoints {
+		if ep.IsHealthy() {
+			return nil
+		}
+	}
+	return ErrNoEndpoint
+}
+
+// Subscribe keeps the endpoint set in sync with r until the client is closed.
+func (c *BalancedClient) Subscribe(r Resolver) {
+	updates := r.Watch(c.ctx)
+
+	go func() {
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			case addrs := <-updates:
+				if len(addrs) == 0 && !c.conf.AllowEmptyUpdate {
+					defaultLogger.Warn("empty endpoint update ignored")
+					continue
+				}
+				if err := c.SetEndpoints(addrs); err != nil {
+					defaultLogger.Warn("update endpoints failed", "endpoints", addrs, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Endpoints returns the current endpoint set.
+func (c *BalancedClient) Endpoints() (endpoints []*Endpoint) {
+	c.RLock()
+	endpoints = c.endpoints
+	c.RUnlock()
+	return
+}
+
+func (c *BalancedClient) Close() {
+	c.closeOnce.Do(func() {
+		c.Lock()
+		c.closed = true
+		endpoints := c.endpoints
+		c.endpoints = nil
+		c.Unlock()
+
+		c.cancel()
+
+		for _, ep := range endpoints {
+			closeEndpoint(ep)
+		}
+	})
+}
+
+func (c *BalancedClient) Disconnect() {
+	for _, ep := range c.Endpoints() {
+		if client := ep.Client(); client != nil && client.IsConnected() {
+			client.Disconnect()
+		}
+	}
+}
+
+func (c *BalancedClient) SetProtocol(p Protocol) {
+	c.Lock()
+	c.protocol = p
+	c.Unlock()
+
+	for _, ep := range c.Endpoints() {
+		if client := ep.Client(); client != nil {
+			client.SetProtocol(p)
+		}
+	}
+}
+
+func (c *BalancedClient) SetIoHandler(h IoHandler) {
+	c.Lock()
+	c.handler = h
+	c.Unlock()
+
+	for _, ep := range c.Endpoints() {
+		if client := ep.Client(); client != nil {
+			client.SetIoHandler(h)
+		}
+	}
+}
+
+func (c *BalancedClient) Call(ctx context.Context, req Request) (Response, error) {
+	return c.CallWithTimeout(ctx, req, 0)
+}
+
+func (c *BalancedClient) CallWithTimeout(ctx context.Context, req Request, timeout time.Duration) (resp Response, err error) {
+	var (
+		ep     *Endpoint
+		client Client
+	)
+
+	if ep, client, err = c.pick(req); err != nil {
+		return
+	}
+
+	if ep.limiter != nil {
+		var done func(error)
+		if done, err = ep.limiter.Acquire(ctx); err != nil {
+			return
+		}
+		defer func() { done(err) }()
+	}
+
+	atomic.AddInt64(&ep.pending, 1)
+	err = c.execute(ep, func() (err error) {
+		resp, err = client.CallWithTimeout(ctx, req, timeout)
+		return
+	})
+	atomic.AddInt64(&ep.pending, -1)
+
+	c.report(ep, err)
+	return
+}
+
+func (c *BalancedClient) Send(ctx context.Context, msg Message) error {
+	return c.SendWithTimeout(ctx, msg, 0)
+}
+
+func (c *BalancedClient) SendWithTimeout(ctx context.Context, msg Message, timeout time.Duration) (err error) {
+	var (
+		ep     *Endpoint
+		client Client
+	)
+
+	if ep, client, err = c.pick(msg); err != nil {
+		return
+	}
+
+	err = c.execute(ep, func() error { return client.SendWithTimeout(ctx, msg, timeout) })
+	c.report(ep, err)
+	return
+}
+
+// GetSession returns nil, a balanced client has one session per endpoint.
+func (c *BalancedClient) GetSession() *IoSession {
+	return nil
+}
+
+func (c *BalancedClient) IsClosed() (closed bool) {
+	c.RLock()
+	closed = c.closed
+	c.RUnlock()
+	return
+}
+
+func (c *BalancedClient) IsConnected() bool {
+	for _, ep := range c.Endpoints() {
+		if client := ep.Client(); client != nil && client.IsConnected() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *BalancedClient) pick(msg Message) (ep *Endpoint, client Client, err error) {
+	if c.IsClosed() {
+		return nil, nil, ErrClientClosed
+	}
+
+	if c.conf.NewLimiter != nil {
+		ep = c.conf.Balancer.Pick(msg, func(ep *Endpoint) bool { return c.available(ep) && !ep.limiter.Full() })
+	}
+
+	if ep == nil {
+		ep = c.conf.Balancer.Pick(msg, c.available)
+	}
+
+	if ep == nil {
+		return nil, nil, ErrNoEndpoint
+	}
+
+	if client = ep.Client(); client == nil {
+		return nil, nil, ErrNoEndpoint
+	}
+	return
+}
+
+// available reports whether ep can take requests.
+func (c *BalancedClient) available(ep *Endpoint) bool {
+	return ep.IsHealthy() && (c.conf.Breakers == nil || !c.conf.Breakers.IsOpen(ep.Addr))
+}
+
+// execute runs fn through the breaker of ep, if any.
+func (c *BalancedClient) execute(ep *Endpoint, fn func() error) error {
+	if c.conf.Breakers == nil {
+		return fn()
+	}
+	return c.conf.Breakers.execute(ep.Addr, fn)
+}
+
+func (c *BalancedClient) report(ep *Endpoint, err error) {
+	if err == nil {
+		atomic.StoreInt32(&ep.failures, 0)
+		return
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrClientClosed) || errors.Is(err, ErrCircuitOpen) {
+		return
+	}
+
+	if c.conf.MaxFailures > 0 && int(atomic.AddInt32(&ep.failures, 1)) >= c.conf.MaxFailures {
+		c.eject(ep)
+	}
+}
+
+func (c *BalancedClient) eject(ep *Endpoint) {
+	atomic.StoreInt32(&ep.failures, 0)
+	atomic.StoreInt64(&ep.ejectedUntil, time.Now().Add(c.conf.EjectDuration).UnixNano())
+	defaultLogger.Warn("endpoint ejected", "addr", ep.Addr, "duration", c.conf.EjectDuration)
+}
+
+func (c *BalancedClient) connect(ep *Endpoint) {
+	client, err := c.factory.NewClient(ep.Addr)
+	if err != nil {
+		defaultLogger.Warn("connect endpoint failed", "addr", ep.Addr, "error", err)
+		c.eject(ep)
+		return
+	}
+
+	c.RLock()
+	p, h := c.protocol, c.handler
+	c.RUnlock()
+
+	// the session takes the protocol and the handler when it is opened
+	if p != nil {
+		client.SetProtocol(p)
+	}
+	if h != nil {
+		client.SetIoHandler(h)
+	}
+
+	if err = client.Dial(ep.Addr); err != nil {
+		client.Close()
+		defaultLogger.Warn("connect endpoint failed", "addr", ep.Addr, "error", err)
+		c.eject(ep)
+		return
+	}
+
+	if old := ep.setClient(client); old != nil {
+		old.Close()
+	}
+}
+
+func (c *BalancedClient) maintainLoop() {
+	interval := c.conf.EjectDuration / 2
+	if interval <= 0 {
+		interval = defaultReconnectInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.reconnectDead()
+		}
+	}
+}
+
+// reconnectDead replaces the clients of endpoints which lost their
+// connection, once they are back from ejection. It holds updateLock so
+// that SetEndpoints can't remove an endpoint while it is reconnected.
+func (c *BalancedClient) reconnectDead() {
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	for _, ep := range c.Endpoints() {
+		if c.IsClosed() {
+			return
+		}
+
+		if ep.IsEjected() {
+			continue
+		}
+
+		if client := ep.Client(); client != nil && client.IsConnected() {
+			continue
+		}
+
+		c.connect(ep)
+
+		// Close may have run while connecting, and found the old client
+		if c.IsClosed() {
+			closeEndpoint(ep)
+			return
+		}
+	}
+}
+
+func (c *BalancedClient) healthCheckLoop() {
+	ticker := time.NewTicker(c.conf.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.checkEndpoints()
+		}
+	}
+}
+
+func (c *BalancedClient) checkEndpoints() {
+	var wg sync.WaitGroup
+
+	for _, ep := range c.Endpoints() {
+		client := ep.Client()
+		if client == nil || ep.IsEjected() {
+			continue
+		}
+
+		wg.Add(1)
+		go func(ep *Endpoint, client Client) {
+			defer wg.Done()
+
+			if err := runHealthCheck(c.ctx, c.conf.HealthChecker, client, c.conf.HealthCheckTimeout); err != nil {
+				if c.IsClosed() {
+					return
+				}
+				defaultLogger.Warn("endpoint health check failed", "addr", ep.Addr, "error", err)
+				c.eject(ep)
+				if ep.clearClient(client) {
+					client.Close()
+				}
+			}
+		}(ep, client)
+	}
+	wg.Wait()
+}
+
+func closeEndpoint(ep *Endpoint) {
+	if client := ep.setClient(nil); client != nil {
+		client.Close()
+	}
+}
@@ -0,0 +1,229 @@
+package knet
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingClient counts the clients of a factory still open.
+type countingClient struct {
+	*MemClient
+	open      *int32
+	closeOnce sync.Once
+}
+
+func (c *countingClient) Close() {
+	c.closeOnce.Do(func() { atomic.AddInt32(c.open, -1) })
+	c.MemClient.Close()
+}
+
+func countingMemFactory(t *testing.T, open *int32) EndpointFactory {
+	return EndpointFactoryFunc(func(addr string) (Client, error) {
+		c := NewMemClient(testContext(t), NewMemClientConfig())
+		c.SetProtocol(testProto{})
+		atomic.AddInt32(open, 1)
+		return &countingClient{MemClient: c, open: open}, nil
+	})
+}
+
+func TestBalancedClientConcurrentSetEndpoints(t *testing.T) {
+	startMemServer(t, "bal-a", &echoHandler{}, nil)
+	startMemServer(t, "bal-b", &echoHandler{}, nil)
+
+	var open int32
+	c := NewBalancedClient(testContext(t), countingMemFactory(t, &open), NewBalancedClientConfig())
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.SetEndpoints([]string{"bal-a", "bal-b"})
+		}()
+	}
+	wg.Wait()
+
+	if n := len(c.Endpoints()); n != 2 {
+		t.Fatalf("%d endpoints, want 2", n)
+	}
+	if n := atomic.LoadInt32(&open); n != 2 {
+		t.Fatalf("%d clients open, want 2", n)
+	}
+}
+
+func TestBalancedClientReconnectWithoutEject(t *testing.T) {
+	startMemServer(t, "bal-reconnect", &echoHandler{}, nil)
+
+	var open int32
+	conf := NewBalancedClientConfig()
+	conf.EjectDuration = 0
+	c := NewBalancedClient(testContext(t), countingMemFactory(t, &open), conf)
+	defer c.Close()
+
+	if err := c.Dial("bal-reconnect"); err != nil {
+		t.Fatal(err)
+	}
+
+	ep := c.Endpoints()[0]
+	first := ep.Client().(*countingClient)
+	first.GetSession().Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if client := ep.Client(); client != nil && client != Client(first) && client.IsConnected() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("dead endpoint not reconnected")
+}
+
+func waitEndpoints(t *testing.T, c *BalancedClient, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for len(c.Endpoints()) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d endpoints, want %d", len(c.Endpoints()), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBalancedClientSubscribeEmptyUpdate(t *testing.T) {
+	startMemServer(t, "bal-sub", &echoHandler{}, nil)
+
+	var open int32
+	r := NewStaticResolver("bal-sub")
+	c := NewBalancedClient(testContext(t), countingMemFactory(t, &open), NewBalancedClientConfig())
+	defer c.Close()
+
+	c.Subscribe(r)
+	waitEndpoints(t, c, 1)
+
+	r.Set()
+	time.Sleep(50 * time.Millisecond)
+	if n := len(c.Endpoints()); n != 1 {
+		t.Fatalf("%d endpoints after an empty update, want 1", n)
+	}
+
+	conf := NewBalancedClientConfig()
+	conf.AllowEmptyUpdate = true
+	opted := NewBalancedClient(testContext(t), countingMemFactory(t, &open), conf)
+	defer opted.Close()
+
+	r.Set("bal-sub")
+	opted.Subscribe(r)
+	waitEndpoints(t, opted, 1)
+
+	r.Set()
+	waitEndpoints(t, opted, 0)
+}
+
+func TestBalancedClientProtocolSetBeforeDial(t *testing.T) {
+	startMemServer(t, "bal-protocol", &echoHandler{}, nil)
+
+	// the factory leaves the protocol to the balanced client
+	factory := EndpointFactoryFunc(func(addr string) (Client, error) {
+		return NewMemClient(testContext(t), NewMemClientConfig()), nil
+	})
+
+	c := NewBalancedClient(testContext(t), factory, NewBalancedClientConfig())
+	defer c.Close()
+	c.SetProtocol(testProto{})
+
+	if err := c.Dial("bal-protocol"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.Call(context.Background(), &testMsg{id: 1, body: "ping"})
+	if err != nil || resp.(*testMsg).body != "ping" {
+		t.Fatalf("Call() = %v, %v, want the echo", resp, err)
+	}
+}
+
+func TestBalancedClientReconnectRemovedEndpoint(t *testing.T) {
+	startMemServer(t, "bal-removed", &echoHandler{}, nil)
+
+	var (
+		open    int32
+		blocked = make(chan struct{})
+		release = make(chan struct{})
+		counted = countingMemFactory(t, &open)
+		block   int32
+	)
+
+	// once armed, the factory blocks until released
+	factory := EndpointFactoryFunc(func(addr string) (Client, error) {
+		if atomic.CompareAndSwapInt32(&block, 1, 0) {
+			close(blocked)
+			<-release
+		}
+		return counted.NewClient(addr)
+	})
+
+	conf := NewBalancedClientConfig()
+	conf.EjectDuration = time.Hour
+	c := NewBalancedClient(testContext(t), factory, conf)
+	defer c.Close()
+
+	if err := c.Dial("bal-removed"); err != nil {
+		t.Fatal(err)
+	}
+
+	session := c.Endpoints()[0].Client().GetSession()
+	session.Close()
+	for c.Endpoints()[0].Client().IsConnected() {
+		time.Sleep(time.Millisecond)
+	}
+
+	atomic.StoreInt32(&block, 1)
+	reconnected := make(chan struct{})
+	go func() {
+		c.reconnectDead()
+		close(reconnected)
+	}()
+	<-blocked
+
+	// the endpoint is removed while it is being reconnected
+	updated := make(chan struct{})
+	go func() {
+		c.SetEndpoints(nil)
+		close(updated)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-reconnected
+	<-updated
+
+	if n := atomic.LoadInt32(&open); n != 0 {
+		t.Fatalf("%d clients open after the endpoint was removed, want 0", n)
+	}
+}
+
+func TestBalancedClientReconnectAfterClose(t *testing.T) {
+	startMemServer(t, "bal-closed", &echoHandler{}, nil)
+
+	var open int32
+	conf := NewBalancedClientConfig()
+	conf.EjectDuration = time.Hour
+	c := NewBalancedClient(testContext(t), countingMemFactory(t, &open), conf)
+
+	if err := c.Dial("bal-closed"); err != nil {
+		t.Fatal(err)
+	}
+	ep := c.Endpoints()[0]
+	c.Close()
+
+	// an endpoint still held by the maintenance loop
+	c.endpoints = []*Endpoint{ep}
+	c.reconnectDead()
+
+	if n := atomic.LoadInt32(&open); n != 0 {
+		t.Fatalf("%d clients open after Close, want 0", n)
+	}
+}
@@ -0,0 +1,99 @@
+package knet
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BandwidthLimit is a rate in bytes per second, with bursts of Burst bytes.
+// A zero Rate means no limit, a zero Burst one second worth of traffic.
+type BandwidthLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// throttle is a token bucket which can be changed or removed while in use.
+type throttle struct {
+	sync.Mutex
+	v atomic.Value
+}
+
+func (t *throttle) bucket() *TokenBucket {
+	b, _ := t.v.Load().(*TokenBucket)
+	return b
+}
+
+func (t *throttle) set(l BandwidthLimit) {
+	t.Lock()
+	defer t.Unlock()
+
+	if l.Rate <= 0 {
+		t.v.Store((*TokenBucket)(nil))
+		return
+	}
+
+	burst := l.Burst
+	if burst <= 0 {
+		burst = int(l.Rate)
+	}
+
+	if b := t.bucket(); b != nil {
+		b.SetRate(l.Rate, burst)
+		return
+	}
+	t.v.Store(NewTokenBucket(l.Rate, burst))
+}
+
+func (t *throttle) limit() (l BandwidthLimit) {
+	if b := t.bucket(); b != nil {
+		b.Lock()
+		l.Rate, l.Burst = b.rate, int(b.burst)
+		b.Unlock()
+	}
+	return
+}
+
+// bandwidth holds the read and write limits of a session or a service.
+type bandwidth struct {
+	read  throttle
+	write throttle
+}
+
+// bandwidthProvider is implemented by the services limiting the bandwidth
+// of their sessions. global is shared by all sessions, read and write are
+// the initial limits of each session.
+type bandwidthProvider interface {
+	bandwidth() (global *bandwidth, read, write BandwidthLimit)
+}
+
+// chunkSize caps n to the smallest burst of buckets, so that a single
+// read or write doesn't run far ahead of the rate.
+func chunkSize(n int, buckets ...*TokenBucket) int {
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+
+		b.Lock()
+		if burst := int(b.burst); n > burst {
+			n = burst
+		}
+		b.Unlock()
+	}
+	return n
+}
+
+// reserve takes n bytes from every bucket and returns the longest wait.
+func reserve(n int, buckets ...*TokenBucket) (wait time.Duration) {
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+
+		if d := b.ReserveN(n); d > wait {
+			wait = d
+		}
+	}
+	return
+}
@@ -0,0 +1,127 @@
+package knet
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// throttledPipe returns a Conn over a pipe whose peer discards everything.
+func throttledPipe(t *testing.T) *Conn {
+	local, peer := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		peer.Close()
+	})
+
+	go io.Copy(io.Discard, peer)
+	return newConn(local)
+}
+
+func timeWrite(t *testing.T, c *Conn, n int) time.Duration {
+	t.Helper()
+
+	start := time.Now()
+	if _, err := c.Write(make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func checkElapsed(t *testing.T, what string, d, min, max time.Duration) {
+	t.Helper()
+
+	if d < min || d > max {
+		t.Fatalf("%s took %v, want between %v and %v", what, d, min, max)
+	}
+}
+
+func TestConnWriteLimit(t *testing.T) {
+	c := throttledPipe(t)
+	c.SetWriteLimit(BandwidthLimit{Rate: 10000, Burst: 1000})
+
+	// the burst is free, the 3000 bytes left take 300ms
+	checkElapsed(t, "write", timeWrite(t, c, 4000), 250*time.Millisecond, time.Second)
+}
+
+func TestConnReadLimit(t *testing.T) {
+	local, peer := net.Pipe()
+	defer local.Close()
+	defer peer.Close()
+
+	go peer.Write(make([]byte, 4000))
+
+	c := newConn(local)
+	c.SetReadLimit(BandwidthLimit{Rate: 10000, Burst: 1000})
+
+	start := time.Now()
+	b := make([]byte, 4000)
+	for read := 0; read < len(b); {
+		n, err := c.Read(b[read:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 1000 {
+			t.Fatalf("read %d bytes at once, want at most the burst", n)
+		}
+		read += n
+	}
+	checkElapsed(t, "read", time.Since(start), 250*time.Millisecond, time.Second)
+}
+
+func TestServiceBandwidthShared(t *testing.T) {
+	srv := NewIoServiceBase(&IoConfig{})
+	srv.SetBandwidth(BandwidthLimit{}, BandwidthLimit{Rate: 10000, Burst: 1000})
+	global, _, _ := srv.bandwidth()
+
+	var (
+		wg      sync.WaitGroup
+		elapsed [2]time.Duration
+	)
+
+	// alone each write would take 100ms, together they share the rate
+	for i := range elapsed {
+		c := throttledPipe(t)
+		c.global = global
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := time.Now()
+			c.Write(make([]byte, 2000))
+			elapsed[i] = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+
+	slowest := elapsed[0]
+	if elapsed[1] > slowest {
+		slowest = elapsed[1]
+	}
+	checkElapsed(t, "shared writes", slowest, 250*time.Millisecond, time.Second)
+}
+
+func TestConnLimitUpdate(t *testing.T) {
+	c := throttledPipe(t)
+	c.SetWriteLimit(BandwidthLimit{Rate: 1000})
+	if l := c.WriteLimit(); l.Rate != 1000 || l.Burst != 1000 {
+		t.Fatalf("WriteLimit() = %+v, want a one second burst", l)
+	}
+
+	// empties the bucket, 10000 more bytes would take 10s
+	timeWrite(t, c, 1000)
+
+	c.SetWriteLimit(BandwidthLimit{Rate: 1e6, Burst: 10000})
+	if l := c.WriteLimit(); l.Rate != 1e6 || l.Burst != 10000 {
+		t.Fatalf("WriteLimit() = %+v after the update", l)
+	}
+	checkElapsed(t, "write after raising the limit", timeWrite(t, c, 10000), 0, 500*time.Millisecond)
+
+	c.SetWriteLimit(BandwidthLimit{})
+	if l := c.WriteLimit(); l != (BandwidthLimit{}) {
+		t.Fatalf("WriteLimit() = %+v after removing the limit, want none", l)
+	}
+	checkElapsed(t, "unlimited write", timeWrite(t, c, 1<<20), 0, 500*time.Millisecond)
+}
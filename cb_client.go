@@ -2,54 +2,244 @@ package knet
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/sony/gobreaker"
 )
 
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitOpenError is returned when a breaker rejects a request, either
+// because it is open or because it is half-open and already probing.
+// It matches ErrCircuitOpen with errors.Is.
+type CircuitOpenError struct {
+	Name string
+	Err  error
+}
+
+func (e *CircuitOpenError) Error() string {
+	if e.Name == "" {
+		return ErrCircuitOpen.Error()
+	}
+	return ErrCircuitOpen.Error() + ": " + e.Name
+}
+
+func (e *CircuitOpenError) Is(target error) bool { return target == ErrCircuitOpen }
+func (e *CircuitOpenError) Unwrap() error        { return e.Err }
+
+// breakerError maps the rejections of gobreaker to a CircuitOpenError. The
+// request was never sent in that case.
+func breakerError(name string, err error) error {
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		return &CircuitOpenError{Name: name, Err: err}
+	}
+	return err
+}
+
+// DefaultIsFailure counts every error as a breaker failure except the ones
+// caused by the caller: cancelled or expired contexts and closed clients.
+func DefaultIsFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	return !errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded) &&
+		!errors.Is(err, ErrClientClosed) &&
+		!errors.Is(err, ErrCircuitOpen)
+}
+
+type BreakerConfig struct {
+	// MaxRequests is the number of requests let through while half-open.
+	MaxRequests uint32
+	// Interval is the period the closed state clears its counts, 0 means
+	// never.
+	Interval time.Duration
+	// Timeout is how long the breaker stays open before probing.
+	Timeout time.Duration
+	// ReadyToTrip decides when to open, defaults to more than 5
+	// consecutive failures.
+	ReadyToTrip func(counts gobreaker.Counts) bool
+	// IsFailure classifies the errors counted as failures, defaults to
+	// DefaultIsFailure.
+	IsFailure func(err error) bool
+}
+
+func NewBreakerConfig() *BreakerConfig {
+	return &BreakerConfig{
+		MaxRequests: 1,
+		Timeout:     30 * time.Second,
+		IsFailure:   DefaultIsFailure,
+	}
+}
+
+func (conf *BreakerConfig) isFailure(err error) bool {
+	if conf.IsFailure == nil {
+		return DefaultIsFailure(err)
+	}
+	return conf.IsFailure(err)
+}
+
+func (conf *BreakerConfig) settings(name string) gobreaker.Settings {
+	return gobreaker.Settings{
+		Name:          name,
+		MaxRequests:   conf.MaxRequests,
+		Interval:      conf.Interval,
+		Timeout:       conf.Timeout,
+		ReadyToTrip:   conf.ReadyToTrip,
+		OnStateChange: logStateChange,
+		IsSuccessful:  func(err error) bool { return !conf.isFailure(err) },
+	}
+}
+
+func logStateChange(name string, from, to gobreaker.State) {
+	defaultLogger.Info("circuit breaker state changed", "name", name, "from", from, "to", to)
+}
+
+// NewCircuitBreaker creates a breaker for NewCircuitBreakerClient.
+func NewCircuitBreaker(name string, conf *BreakerConfig) *gobreaker.CircuitBreaker {
+	return gobreaker.NewCircuitBreaker(conf.settings(name))
+}
+
 type CircuitBreakerClient struct {
-	breaker *gobreaker.CircuitBreaker
+	execute func(fn func() error) error
 	Client
 }
 
 func NewCircuitBreakerClient(client Client, breaker *gobreaker.CircuitBreaker) *CircuitBreakerClient {
 	return &CircuitBreakerClient{
-		Client:  client,
-		breaker: breaker,
+		Client: client,
+		execute: func(fn func() error) error {
+			_, err := breaker.Execute(func() (interface{}, error) { return nil, fn() })
+			return breakerError(breaker.Name(), err)
+		},
 	}
 }
 
-func (c *CircuitBreakerClient) Dial(addr string) (err error) {
-	_, err = c.breaker.Execute(func() (interface{}, error) { return nil, c.Client.Dial(addr) })
-	return
+func (c *CircuitBreakerClient) Dial(addr string) error {
+	return c.execute(func() error { return c.Client.Dial(addr) })
 }
 
 func (c *CircuitBreakerClient) Call(ctx context.Context, req Request) (resp Response, err error) {
-	var reply interface{}
-
-	reply, err = c.breaker.Execute(func() (interface{}, error) { return c.Client.Call(ctx, req) })
-	if err == nil {
-		resp = reply.(Response)
-	}
+	err = c.execute(func() (err error) {
+		resp, err = c.Client.Call(ctx, req)
+		return
+	})
 	return
 }
 
 func (c *CircuitBreakerClient) CallWithTimeout(ctx context.Context, req Request, timeout time.Duration) (resp Response, err error) {
-	var reply interface{}
+	err = c.execute(func() (err error) {
+		resp, err = c.Client.CallWithTimeout(ctx, req, timeout)
+		return
+	})
+	return
+}
 
-	reply, err = c.breaker.Execute(func() (interface{}, error) { return c.Client.CallWithTimeout(ctx, req, timeout) })
-	if err == nil {
-		resp = reply.(Response)
+func (c *CircuitBreakerClient) Send(ctx context.Context, msg Message) error {
+	return c.execute(func() error { return c.Client.Send(ctx, msg) })
+}
+
+func (c *CircuitBreakerClient) SendWithTimeout(ctx context.Context, msg Message, timeout time.Duration) error {
+	return c.execute(func() error { return c.Client.SendWithTimeout(ctx, msg, timeout) })
+}
+
+// BreakerRegistry keeps one breaker per endpoint address, created on first
+// use. Balanced clients and client pools consult it to route around open
+// endpoints.
+type BreakerRegistry struct {
+	sync.Mutex
+	conf     *BreakerConfig
+	breakers map[string]*gobreaker.TwoStepCircuitBreaker
+}
+
+func NewBreakerRegistry(conf *BreakerConfig) *BreakerRegistry {
+	return &BreakerRegistry{
+		conf:     conf,
+		breakers: make(map[string]*gobreaker.TwoStepCircuitBreaker),
 	}
-	return
 }
 
-func (c *CircuitBreakerClient) Send(ctx context.Context, msg Message) (err error) {
-	_, err = c.breaker.Execute(func() (interface{}, error) { return nil, c.Client.Send(ctx, msg) })
-	return
+// Get returns the breaker of an endpoint, creating it if needed.
+func (r *BreakerRegistry) Get(name string) *gobreaker.TwoStepCircuitBreaker {
+	r.Lock()
+	defer r.Unlock()
+
+	cb, ok := r.breakers[name]
+	if !ok {
+		cb = gobreaker.NewTwoStepCircuitBreaker(r.conf.settings(name))
+		r.breakers[name] = cb
+	}
+	return cb
 }
 
-func (c *CircuitBreakerClient) SendWithTimeout(ctx context.Context, msg Message, timeout time.Duration) (err error) {
-	_, err = c.breaker.Execute(func() (interface{}, error) { return nil, c.Client.SendWithTimeout(ctx, msg, timeout) })
-	return
+// Remove drops the breaker of an endpoint gone from the endpoint set.
+func (r *BreakerRegistry) Remove(name string) {
+	r.Lock()
+	delete(r.breakers, name)
+	r.Unlock()
+}
+
+// State returns the state of an endpoint's breaker, endpoints without one
+// are closed.
+func (r *BreakerRegistry) State(name string) gobreaker.State {
+	r.Lock()
+	cb, ok := r.breakers[name]
+	r.Unlock()
+
+	if !ok {
+		return gobreaker.StateClosed
+	}
+	return cb.State()
+}
+
+// States returns the state of every breaker.
+func (r *BreakerRegistry) States() map[string]gobreaker.State {
+	r.Lock()
+	breakers := make(map[string]*gobreaker.TwoStepCircuitBreaker, len(r.breakers))
+	for name, cb := range r.breakers {
+		breakers[name] = cb
+	}
+	r.Unlock()
+
+	states := make(map[string]gobreaker.State, len(breakers))
+	for name, cb := range breakers {
+		states[name] = cb.State()
+	}
+	return states
+}
+
+// IsOpen reports whether requests to the endpoint are currently rejected.
+func (r *BreakerRegistry) IsOpen(name string) bool {
+	return r.State(name) == gobreaker.StateOpen
+}
+
+// Allow asks the endpoint's breaker to let one request through. done must
+// be called with the outcome of the request.
+func (r *BreakerRegistry) Allow(name string) (done func(err error), err error) {
+	allowed, err := r.Get(name).Allow()
+	if err != nil {
+		return nil, breakerError(name, err)
+	}
+	return func(err error) { allowed(!r.conf.isFailure(err)) }, nil
+}
+
+func (r *BreakerRegistry) execute(name string, fn func() error) error {
+	done, err := r.Allow(name)
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	done(err)
+	return err
+}
+
+// Client wraps client with the breaker of the named endpoint.
+func (r *BreakerRegistry) Client(name string, client Client) *CircuitBreakerClient {
+	return &CircuitBreakerClient{
+		Client:  client,
+		execute: func(fn func() error) error { return r.execute(name, fn) },
+	}
 }
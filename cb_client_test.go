@@ -0,0 +1,151 @@
+package knet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sony/gobreaker"
+)
+
+var errBackend = errors.New("backend failure")
+
+// failingClient fails every call with err, counting the calls.
+type failingClient struct {
+	errClient
+	calls int
+}
+
+func (c *failingClient) Call(ctx context.Context, req Request) (Response, error) {
+	c.calls++
+	return nil, c.err
+}
+
+func tripAfter(n uint32) *BreakerConfig {
+	conf := NewBreakerConfig()
+	conf.ReadyToTrip = func(counts gobreaker.Counts) bool { return counts.ConsecutiveFailures >= n }
+	return conf
+}
+
+func TestDefaultIsFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errBackend, true},
+		{ErrTimeout, true},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{fmt.Errorf("call: %w", context.Canceled), false},
+		{ErrClientClosed, false},
+		{&CircuitOpenError{Name: "a"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := DefaultIsFailure(tt.err); got != tt.want {
+			t.Errorf("DefaultIsFailure(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBreakerRegistryTrips(t *testing.T) {
+	r := NewBreakerRegistry(tripAfter(3))
+
+	report := func(name string, err error) {
+		done, aerr := r.Allow(name)
+		if aerr != nil {
+			t.Fatalf("Allow(%s) error = %v", name, aerr)
+		}
+		done(err)
+	}
+
+	// the errors caused by the caller don't count
+	for i := 0; i < 5; i++ {
+		report("a", context.Canceled)
+	}
+	if r.IsOpen("a") {
+		t.Fatal("breaker tripped by cancelled calls")
+	}
+
+	for i := 0; i < 3; i++ {
+		report("a", errBackend)
+	}
+	if !r.IsOpen("a") {
+		t.Fatalf("breaker state = %v after 3 failures, want open", r.State("a"))
+	}
+
+	// the breakers are per endpoint
+	if r.IsOpen("b") {
+		t.Fatal("breaker of another endpoint tripped")
+	}
+	report("b", nil)
+
+	_, err := r.Allow("a")
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || openErr.Name != "a" || !errors.Is(err, ErrCircuitOpen) || !errors.Is(err, gobreaker.ErrOpenState) {
+		t.Fatalf("Allow() error = %v on an open breaker, want a CircuitOpenError", err)
+	}
+
+	want := map[string]gobreaker.State{"a": gobreaker.StateOpen, "b": gobreaker.StateClosed}
+	if states := r.States(); len(states) != 2 || states["a"] != want["a"] || states["b"] != want["b"] {
+		t.Fatalf("States() = %v, want %v", states, want)
+	}
+
+	// a removed endpoint starts over
+	r.Remove("a")
+	if r.IsOpen("a") {
+		t.Fatal("removed breaker still open")
+	}
+}
+
+func TestBreakerRegistryIsFailure(t *testing.T) {
+	conf := tripAfter(1)
+	conf.IsFailure = func(err error) bool { return err != nil && !errors.Is(err, ErrTimeout) }
+	r := NewBreakerRegistry(conf)
+
+	c := &failingClient{errClient: errClient{err: ErrTimeout}}
+	client := r.Client("a", c)
+	for i := 0; i < 3; i++ {
+		client.Call(context.Background(), &testMsg{id: 1})
+	}
+	if r.IsOpen("a") {
+		t.Fatal("breaker tripped by errors excluded by IsFailure")
+	}
+
+	c.err = errBackend
+	if _, err := client.Call(context.Background(), &testMsg{id: 1}); err != errBackend {
+		t.Fatalf("Call() error = %v, want %v", err, errBackend)
+	}
+
+	// an open circuit doesn't reach the client
+	calls := c.calls
+	_, err := client.Call(context.Background(), &testMsg{id: 1})
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Call() error = %v on an open circuit, want %v", err, ErrCircuitOpen)
+	}
+	if c.calls != calls {
+		t.Fatal("call sent through an open circuit")
+	}
+}
+
+func TestCircuitBreakerClient(t *testing.T) {
+	c := &failingClient{errClient: errClient{err: errBackend}}
+	client := NewCircuitBreakerClient(c, NewCircuitBreaker("backend", tripAfter(2)))
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Call(context.Background(), &testMsg{id: 1}); err != errBackend {
+			t.Fatalf("Call() error = %v, want %v", err, errBackend)
+		}
+	}
+
+	_, err := client.Call(context.Background(), &testMsg{id: 1})
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || openErr.Name != "backend" {
+		t.Fatalf("Call() error = %v on an open circuit, want a CircuitOpenError", err)
+	}
+	if c.calls != 2 {
+		t.Fatalf("%d calls reached the client, want 2", c.calls)
+	}
+}
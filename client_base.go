@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +24,9 @@ type ClientConfig struct {
 		WriteTimeout  time.Duration
 	}
 	AutoReconnect bool
+	// MaxInFlight caps the concurrent calls, the callers above it wait for
+	// a slot until their context is done. 0 means no limit.
+	MaxInFlight int
 }
 
 func NewClientConfig() *ClientConfig {
@@ -50,6 +54,11 @@ type ClientBase struct {
 	closed       bool
 	pendingLock  sync.Mutex
 	pendingMap   map[uint64]*pendingRequest
+	limiter      *Limiter
+
+	// reconnectFailing is set from the first failed reconnection of an
+	// outage until the client is connected again
+	reconnectFailing uint32
 
 	ctx       context.Context
 	cancel    context.CancelFunc
@@ -74,6 +83,9 @@ func NewClientBase(ctx context.Context, dial DialFunc, conf *ClientConfig) *Clie
 	}
 	c.IoServiceBase.SetIoHandler(c)
 
+	if conf.MaxInFlight > 0 {
+		c.limiter = NewLimiter(NewFixedLimit(conf.MaxInFlight), 0)
+	}
 	return c
 }
 
@@ -98,7 +110,7 @@ func (c *ClientBase) Close() {
 
 		session := c.GetSession()
 		if session != nil {
-			session.Close()
+			session.closeWith(CloseReason{Cause: CloseShutdown})
 		}
 
 		c.cancel()
@@ -115,7 +127,7 @@ func (c *ClientBase) SendWithTimeout(ctx context.Context, msg Message, timeout t
 	}
 
 	if err = c.ensureConnected(false); err != nil {
-		return
+		return err
 	}
 
 	return c.GetSession().SendWithTimeout(ctx, msg, timeout)
@@ -126,12 +138,31 @@ func (c *ClientBase) Call(ctx context.Context, req Request) (Response, error) {
 }
 
 func (c *ClientBase) CallWithTimeout(ctx context.Context, req Request, timeout time.Duration) (resp Response, err error) {
+	if m := c.metrics(); m != nil {
+		tBegin := time.Now()
+		defer func() { m.CallDone(c.remoteAddr, time.Since(tBegin), err) }()
+	}
+
+	if t := c.tracer(); t != nil {
+		var span Span
+		ctx, span = t.StartSpan(ctx, SpanCall, time.Now(), c.GetSession(), req)
+		defer func() { span.End(err) }()
+	}
+
 	if c.IsClosed() {
 		return nil, ErrClientClosed
 	}
 
+	if c.limiter != nil {
+		var done func(error)
+		if done, err = c.limiter.Acquire(ctx); err != nil {
+			return
+		}
+		defer func() { done(err) }()
+	}
+
 	if err = c.ensureConnected(false); err != nil {
-		return
+		return nil, err
 	}
 
 	pendingReq := &pendingRequest{
@@ -147,37 +178,48 @@ func (c *ClientBase) CallWithTimeout(ctx context.Context, req Request, timeout t
 	tBegin := time.Now()
 
 	if err = c.GetSession().SendWithTimeout(ctx, req, timeout); err != nil {
+		c.removePending(req.Id(), pendingReq)
+		return nil, err
+	}
+
+	// the time spent waiting for the send queue counts against the timeout
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout - time.Since(tBegin))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-c.ctx.Done():
+		err = ErrClientClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	case resp = <-pendingReq.replyCh:
+		return
+	case err = <-pendingReq.errorCh:
 		return
+	case <-expired:
+		err = ErrTimeout
 	}
 
-	if timeout == 0 {
-		select {
-		case <-c.ctx.Done():
-			return nil, ErrClientClosed
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case resp = <-pendingReq.replyCh:
-		case err = <-pendingReq.errorCh:
-		}
-	} else {
-		wait := time.Since(tBegin)
-
-		select {
-		case <-c.ctx.Done():
-			return nil, ErrClientClosed
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case resp = <-pendingReq.replyCh:
-		case err = <-pendingReq.errorCh:
-		case <-time.After(wait):
-			{
-				c.pendingLock.Lock()
-				delete(c.pendingMap, req.Id())
-				c.pendingLock.Unlock()
-				err = ErrTimeout
-			}
-		}
+	c.removePending(req.Id(), pendingReq)
+	return nil, err
+}
+
+func (c *ClientBase) removePending(id uint64, req *pendingRequest) {
+	c.pendingLock.Lock()
+	if c.pendingMap[id] == req {
+		delete(c.pendingMap, id)
 	}
+	c.pendingLock.Unlock()
+}
+
+// PendingCount returns the number of calls waiting for a response.
+func (c *ClientBase) PendingCount() (n int) {
+	c.pendingLock.Lock()
+	n = len(c.pendingMap)
+	c.pendingLock.Unlock()
 	return
 }
 
@@ -285,10 +327,20 @@ func (c *ClientBase) ensureConnected(force bool) (err error) {
 	}
 
 	if conn, err = c.dial(c.remoteAddr); err != nil {
+		switch {
+		case force:
+		case atomic.CompareAndSwapUint32(&c.reconnectFailing, 0, 1):
+			defaultLogger.Warn("reconnect failed", "addr", c.remoteAddr, "error", err)
+		default:
+			defaultLogger.Debug("reconnect failed", "addr", c.remoteAddr, "error", err)
+		}
 		return
 	}
 
 	session = NewIoSession(c.ctx, c, conn)
+	if atomic.SwapUint32(&c.reconnectFailing, 0) == 1 || !force {
+		defaultLogger.Info("client reconnected", sessionFields(session, "addr", c.remoteAddr)...)
+	}
 	session.Open()
 	return
 }
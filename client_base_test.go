@@ -0,0 +1,117 @@
+package knet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallTimeoutIncludesSend(t *testing.T) {
+	ln, err := MemListen("call-slow-send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// a peer that starts reading late and never replies
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		time.Sleep(300 * time.Millisecond)
+		io.Copy(io.Discard, conn)
+	}()
+
+	conf := NewMemClientConfig()
+	conf.Io.SendQueueSize = 0
+	c := NewMemClient(testContext(t), conf)
+	c.SetProtocol(testProto{})
+	if err = c.Dial("call-slow-send"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// blocks the write loop until the peer reads
+	c.Send(context.Background(), &testMsg{id: 1})
+
+	start := time.Now()
+	_, err = c.CallWithTimeout(context.Background(), &testMsg{id: 2}, 400*time.Millisecond)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("CallWithTimeout() error = %v, want %v", err, ErrTimeout)
+	}
+	if elapsed > 600*time.Millisecond {
+		t.Fatalf("CallWithTimeout() took %v, the time spent sending was not counted", elapsed)
+	}
+}
+
+func TestReconnectFailureLoggedOnce(t *testing.T) {
+	startMemServer(t, "reconnect-log", &echoHandler{}, nil)
+	logs := captureLogs(t)
+
+	down := int32(1)
+	dial := func(addr string) (net.Conn, error) {
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return MemDial(addr)
+	}
+
+	conf := NewClientConfig()
+	conf.AutoReconnect = true
+	c := NewClientBase(testContext(t), dial, conf)
+	c.SetProtocol(testProto{})
+	defer c.Close()
+
+	// the first dial reports its error to the caller
+	if err := c.Dial("reconnect-log"); err == nil {
+		t.Fatal("dial succeeded with the backend down")
+	}
+
+	outage := func() {
+		for i := 0; i < 3; i++ {
+			if _, err := c.Call(context.Background(), &testMsg{id: uint64(i)}); err == nil {
+				t.Fatal("call succeeded with the backend down")
+			}
+		}
+	}
+
+	outage()
+	if n := logs.count(LevelWarn, "reconnect failed"); n != 1 {
+		t.Fatalf("%d reconnect warnings, want 1", n)
+	}
+	if n := logs.count(LevelDebug, "reconnect failed"); n != 2 {
+		t.Fatalf("%d reconnect debug records, want 2", n)
+	}
+
+	atomic.StoreInt32(&down, 0)
+	if _, err := c.Call(context.Background(), &testMsg{id: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if n := logs.count(LevelInfo, "client reconnected"); n != 1 {
+		t.Fatalf("%d reconnected records, want 1", n)
+	}
+
+	// a new outage warns again
+	atomic.StoreInt32(&down, 1)
+	c.GetSession().Close()
+	for deadline := time.Now().Add(3 * time.Second); c.IsConnected(); {
+		if time.Now().After(deadline) {
+			t.Fatal("client still connected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	outage()
+	if n := logs.count(LevelWarn, "reconnect failed"); n != 2 {
+		t.Fatalf("%d reconnect warnings, want 2", n)
+	}
+}
@@ -4,28 +4,90 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var ErrClientPoolClosed = errors.New("client manager closed")
+var (
+	ErrClientPoolClosed    = errors.New("client pool closed")
+	ErrClientPoolExhausted = errors.New("client pool exhausted")
+)
 
 type ClientPoolConfig struct {
+	// IdleMin is the number of idle clients kept ready.
 	IdleMin int `json:"idle_min"`
+	// IdleMax caps the idle clients, defaults to Max.
 	IdleMax int `json:"idle_max"`
-	Max     int `json:"max"`
+	// Max caps the open clients, 0 means no limit.
+	Max int `json:"max"`
+	// WaitTimeout bounds the time Get waits for a client when Max is
+	// reached, in addition to the deadline of the context, 0 means no limit.
+	WaitTimeout time.Duration `json:"wait_timeout"`
+	// IdleTimeout closes clients idle for longer, 0 means never.
+	IdleTimeout time.Duration `json:"idle_timeout"`
+	// MaxLifetime closes clients older than this, 0 means never.
+	MaxLifetime time.Duration `json:"max_lifetime"`
+	// MaintainInterval is the period of the background reaping.
+	MaintainInterval time.Duration `json:"maintain_interval"`
+
+	// TestOnBorrow runs the health checker on idle clients before handing
+	// them out. Disconnected clients are never handed out.
+	TestOnBorrow        bool          `json:"test_on_borrow"`
+	HealthCheckInterval time.Duration `json:"health_check_interval"`
+	HealthCheckTimeout  time.Duration `json:"health_check_timeout"`
+	HealthChecker       HealthChecker `json:"-"`
+
+	// Breakers, if set, runs the calls of borrowed clients through the
+	// breaker of their endpoint, named by the address for clients created
+	// through Subscribe. Endpoints with an open breaker get no new clients.
+	Breakers *BreakerRegistry `json:"-"`
+	// AllowEmptyUpdate makes Subscribe apply an empty resolver result,
+	// evicting every client. By default it is taken for a resolver failure
+	// and ignored.
+	AllowEmptyUpdate bool `json:"allow_empty_update"`
+}
+
+type PoolStats struct {
+	MaxOpen int
+	Open    int
+	Idle    int
+	InUse   int
+
+	WaitCount    uint64
+	WaitDuration time.Duration
+
+	Created           uint64
+	Destroyed         uint64
+	IdleClosed        uint64
+	LifetimeClosed    uint64
+	HealthChecks      uint64
+	HealthCheckFailed uint64
+	Evicted           uint64
 }
 
 type ClientFactory interface {
 	NewClient() (Client, error)
 }
 
+type poolEntry struct {
+	Client
+	createdAt  time.Time
+	returnedAt time.Time
+}
+
+func (e *poolEntry) expired(now time.Time, lifetime time.Duration) bool {
+	return lifetime > 0 && now.Sub(e.createdAt) >= lifetime
+}
+
 type ClientPool struct {
 	sync.Mutex
-	conf     ClientPoolConfig
-	factory  ClientFactory
-	num      int
-	freeList chan Client
-	closed   bool
+	conf    ClientPoolConfig
+	factory ClientFactory
+	numOpen int
+	idle    []*poolEntry
+	waiters []chan *poolEntry
+	closed  bool
+	stats   PoolStats
 
 	ctx       context.Context
 	cancel    context.CancelFunc
@@ -35,151 +97,506 @@ type ClientPool struct {
 func NewClientPool(ctx context.Context, factory ClientFactory, conf ClientPoolConfig) *ClientPool {
 	newctx, cancel := context.WithCancel(ctx)
 
-	if conf.IdleMax < conf.Max {
+	if conf.IdleMax <= 0 || (conf.Max > 0 && conf.IdleMax > conf.Max) {
 		conf.IdleMax = conf.Max
 	}
 
-	if conf.IdleMin > conf.IdleMax {
+	if conf.IdleMax > 0 && conf.IdleMin > conf.IdleMax {
 		conf.IdleMin = conf.IdleMax
 	}
 
+	if conf.MaintainInterval <= 0 {
+		conf.MaintainInterval = time.Second
+	}
+
 	p := &ClientPool{
-		conf:     conf,
-		factory:  factory,
-		freeList: make(chan Client, conf.IdleMax),
-		ctx:      newctx,
-		cancel:   cancel,
+		conf:    conf,
+		factory: factory,
+		ctx:     newctx,
+		cancel:  cancel,
+	}
+
+	go p.maintainLoop()
+
+	if conf.HealthCheckInterval > 0 {
+		go p.healthCheckLoop()
 	}
 	return p
 }
 
 func (p *ClientPool) Open() error {
-	if p.factory == nil {
+	if p.getFactory() == nil {
 		panic("client factory not defined")
 	}
-
-	for i := 0; i < p.conf.IdleMin; i++ {
-		client, err := p.factory.NewClient()
-		if err != nil {
-			return err
-		}
-
-		p.Lock()
-		p.num++
-		p.Unlock()
-		p.freeList <- client
-	}
-
-	return nil
+	return p.fillIdle()
 }
 
 func (p *ClientPool) Close() {
 	p.closeOnce.Do(func() {
 		p.Lock()
 		p.closed = true
+		idle := p.idle
+		p.idle = nil
+		waiters := p.waiters
+		p.waiters = nil
+		p.numOpen -= len(idle)
+		p.stats.Destroyed += uint64(len(idle))
 		p.Unlock()
 
 		p.cancel()
 
-		close(p.freeList)
-
-		for c := range p.freeList {
-			c.Close()
+		for _, ch := range waiters {
+			close(ch)
 		}
 
+		for _, e := range idle {
+			e.Close()
+		}
 	})
 }
 
-func (p *ClientPool) Get() Client {
-	c, err := p.get()
+func (p *ClientPool) isClosed() (closed bool) {
+	p.Lock()
+	closed = p.closed
+	p.Unlock()
+	return
+}
+
+// Subscribe makes the pool create its clients with factory, spread over the
+// endpoints produced by r. The clients of factory must come with their
+// protocol and handler set, the pool only dials them. Clients of removed endpoints are closed instead of
+// being reused.
+func (p *ClientPool) Subscribe(r Resolver, factory EndpointFactory) {
+	rf := &resolverClientFactory{factory: factory, breakers: p.conf.Breakers}
+
+	p.Lock()
+	p.factory = rf
+	p.Unlock()
+
+	updates := r.Watch(p.ctx)
+
+	go func() {
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case addrs := <-updates:
+				if len(addrs) == 0 && !p.conf.AllowEmptyUpdate {
+					defaultLogger.Warn("empty endpoint update ignored")
+					continue
+				}
+				rf.setAddrs(addrs)
+				p.evict(isStaleClient)
+			}
+		}
+	}()
+}
+
+// Get borrows a client, waiting for one to be returned if Max is reached.
+// The client must be given back to the pool with Close.
+func (p *ClientPool) Get(ctx context.Context) (Client, error) {
+	e, err := p.get(ctx)
 	if err != nil {
-		return &errClient{err}
+		return nil, err
 	}
 
-	return &pooledClient{
+	pc := &pooledClient{
 		p:      p,
-		Client: c,
+		entry:  e,
+		Client: e.Client,
+	}
+
+	if r := p.conf.Breakers; r != nil {
+		pc.Client = r.Client(endpointAddr(e.Client), e.Client)
+	}
+	return pc, nil
+}
+
+func (p *ClientPool) get(ctx context.Context) (e *poolEntry, err error) {
+	for {
+		p.Lock()
+
+		if p.closed {
+			p.Unlock()
+			return nil, ErrClientPoolClosed
+		}
+
+		if n := len(p.idle); n > 0 {
+			e = p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.Unlock()
+
+			if p.validate(e) {
+				return
+			}
+			continue
+		}
+
+		if p.conf.Max <= 0 || p.numOpen < p.conf.Max {
+			p.numOpen++
+			p.Unlock()
+			return p.create()
+		}
+
+		ch := make(chan *poolEntry, 1)
+		p.waiters = append(p.waiters, ch)
+		p.stats.WaitCount++
+		p.Unlock()
+
+		if e, err = p.wait(ctx, ch); err != nil {
+			return
+		}
+
+		// a nil entry hands over the slot of a destroyed client
+		if e == nil {
+			return p.create()
+		}
+
+		if p.validate(e) {
+			return
+		}
 	}
 }
 
-func (p *ClientPool) get() (c Client, err error) {
-	if p.isClosed() {
-		return nil, ErrClientPoolClosed
+func (p *ClientPool) wait(ctx context.Context, ch chan *poolEntry) (e *poolEntry, err error) {
+	var (
+		tBegin  = time.Now()
+		timeout <-chan time.Time
+		ok      bool
+	)
+
+	defer func() {
+		p.Lock()
+		p.stats.WaitDuration += time.Since(tBegin)
+		p.Unlock()
+	}()
+
+	if p.conf.WaitTimeout > 0 {
+		timer := time.NewTimer(p.conf.WaitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
 	select {
-	case c = <-p.freeList:
+	case e, ok = <-ch:
+		if !ok {
+			return nil, ErrClientPoolClosed
+		}
 		return
-	default:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ErrClientPoolExhausted
 	}
 
-	if p.isMaxReached() {
-		select {
-		case <-p.ctx.Done():
-			return nil, ErrClientPoolClosed
-		case c = <-p.freeList:
+	p.Lock()
+	for i, w := range p.waiters {
+		if w == ch {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			p.Unlock()
+			return
 		}
-		return
 	}
+	p.Unlock()
+
+	// we were handed something while giving up, pass it on
+	if e, ok = <-ch; ok {
+		p.release(e)
+	}
+	return
+}
+
+func (p *ClientPool) create() (e *poolEntry, err error) {
+	var c Client
 
-	if c, err = p.factory.NewClient(); err != nil {
+	if c, err = p.getFactory().NewClient(); err != nil {
+		p.release(nil)
 		return
 	}
 
 	p.Lock()
-	p.num++
+	p.stats.Created++
+	open := p.numOpen
 	p.Unlock()
+
+	defaultLogger.Debug("pool client created", "open", open, "max", p.conf.Max)
+
+	e = &poolEntry{Client: c, createdAt: time.Now()}
 	return
 }
 
-func (p *ClientPool) put(c Client) {
-	if p.isClosed() {
-		c.Close()
+// put returns a borrowed client to the pool.
+func (p *ClientPool) put(e *poolEntry) {
+	if e.IsClosed() || !e.IsConnected() || isStaleClient(e.Client) {
+		p.destroy(e)
 		return
 	}
 
-	select {
-	case p.freeList <- c:
+	if e.expired(time.Now(), p.conf.MaxLifetime) {
+		p.Lock()
+		p.stats.LifetimeClosed++
+		p.Unlock()
+		p.destroy(e)
+		return
+	}
+
+	e.returnedAt = time.Now()
+	p.release(e)
+}
+
+// release hands e to a waiter or back to the idle list. A nil e means
+// the slot of a destroyed client is free.
+func (p *ClientPool) release(e *poolEntry) {
+	p.Lock()
+
+	if e == nil {
+		p.numOpen--
+	}
+
+	if len(p.waiters) > 0 {
+		ch := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		if e == nil {
+			p.numOpen++
+		}
+		p.Unlock()
+		ch <- e
+		return
+	}
+
+	if e == nil {
+		p.Unlock()
+		return
+	}
+
+	if p.closed || (p.conf.IdleMax > 0 && len(p.idle) >= p.conf.IdleMax) {
+		p.numOpen--
+		p.stats.Destroyed++
+		p.Unlock()
+		e.Close()
 		return
-	default:
 	}
 
+	p.idle = append(p.idle, e)
+	p.Unlock()
+}
+
+func (p *ClientPool) destroy(e *poolEntry) {
 	p.Lock()
-	p.num--
+	p.stats.Destroyed++
 	p.Unlock()
 
-	c.Close()
+	e.Close()
+	p.release(nil)
 }
 
-func (p *ClientPool) isClosed() (closed bool) {
+// evict closes the idle clients matched by stale.
+func (p *ClientPool) evict(stale func(Client) bool) {
 	p.Lock()
-	closed = p.closed
+	var (
+		idle    = p.idle[:0]
+		removed []*poolEntry
+	)
+	for _, e := range p.idle {
+		if stale(e.Client) {
+			removed = append(removed, e)
+		} else {
+			idle = append(idle, e)
+		}
+	}
+	p.idle = idle
+	p.Unlock()
+
+	for _, e := range removed {
+		p.destroy(e)
+	}
+}
+
+// Stats returns the pool statistics.
+func (p *ClientPool) Stats() (stats PoolStats) {
+	p.Lock()
+	stats = p.stats
+	stats.MaxOpen = p.conf.Max
+	stats.Open = p.numOpen
+	stats.Idle = len(p.idle)
+	stats.InUse = p.numOpen - len(p.idle)
 	p.Unlock()
 	return
 }
 
-func (p *ClientPool) isMaxReached() (reached bool) {
+// validate checks an idle client before handing it out, destroying it if
+// it is unusable.
+func (p *ClientPool) validate(e *poolEntry) bool {
+	var err error
+
+	if e.expired(time.Now(), p.conf.MaxLifetime) {
+		p.Lock()
+		p.stats.LifetimeClosed++
+		p.Unlock()
+		p.destroy(e)
+		return false
+	}
+
+	if p.conf.TestOnBorrow {
+		err = p.check(e)
+	} else {
+		err = checkConnected(p.ctx, e.Client)
+	}
+
+	if err != nil {
+		p.Lock()
+		p.stats.Evicted++
+		p.Unlock()
+		p.destroy(e)
+		return false
+	}
+	return true
+}
+
+func (p *ClientPool) check(e *poolEntry) (err error) {
+	err = runHealthCheck(p.ctx, p.conf.HealthChecker, e.Client, p.conf.HealthCheckTimeout)
+
+	p.Lock()
+	p.stats.HealthChecks++
+	if err != nil {
+		p.stats.HealthCheckFailed++
+	}
+	p.Unlock()
+	return
+}
+
+func (p *ClientPool) healthCheckLoop() {
+	ticker := time.NewTicker(p.conf.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkIdle()
+		}
+	}
+}
+
+// checkIdle probes every idle client, evicting the ones failing.
+func (p *ClientPool) checkIdle() {
+	p.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.Unlock()
+
+	for _, e := range idle {
+		if err := p.check(e); err != nil {
+			defaultLogger.Warn("evict unhealthy client", "error", err)
+			p.Lock()
+			p.stats.Evicted++
+			p.Unlock()
+			p.destroy(e)
+			continue
+		}
+		p.release(e)
+	}
+}
+
+func (p *ClientPool) maintainLoop() {
+	ticker := time.NewTicker(p.conf.MaintainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.reap()
+			if err := p.fillIdle(); err != nil {
+				defaultLogger.Warn("refill idle clients failed", "error", err)
+			}
+		}
+	}
+}
+
+// reap closes the idle clients past their idle timeout or lifetime.
+func (p *ClientPool) reap() {
+	var (
+		now                = time.Now()
+		idleClosed, closed int
+	)
+
 	p.Lock()
-	if p.num >= p.conf.Max {
-		reached = true
+	var (
+		idle    = p.idle[:0]
+		removed []*poolEntry
+		// idle timeout never shrinks the pool below IdleMin, the list is
+		// ordered from the least recently used
+		reapable = len(p.idle) - p.conf.IdleMin
+	)
+	for _, e := range p.idle {
+		switch {
+		case e.expired(now, p.conf.MaxLifetime):
+			closed++
+		case p.conf.IdleTimeout > 0 && idleClosed < reapable && now.Sub(e.returnedAt) >= p.conf.IdleTimeout:
+			idleClosed++
+		default:
+			idle = append(idle, e)
+			continue
+		}
+		removed = append(removed, e)
+	}
+	p.idle = idle
+	p.stats.LifetimeClosed += uint64(closed)
+	p.stats.IdleClosed += uint64(idleClosed)
+	p.Unlock()
+
+	for _, e := range removed {
+		p.destroy(e)
+	}
+}
+
+// fillIdle opens clients until IdleMin of them are idle. It does nothing
+// until the pool has a factory.
+func (p *ClientPool) fillIdle() error {
+	for {
+		p.Lock()
+		if p.closed || p.factory == nil || len(p.idle) >= p.conf.IdleMin ||
+			(p.conf.Max > 0 && p.numOpen >= p.conf.Max) {
+			p.Unlock()
+			return nil
+		}
+		p.numOpen++
+		p.Unlock()
+
+		e, err := p.create()
+		if err != nil {
+			return err
+		}
+		e.returnedAt = time.Now()
+		p.release(e)
 	}
+}
+
+func (p *ClientPool) getFactory() (factory ClientFactory) {
+	p.Lock()
+	factory = p.factory
 	p.Unlock()
 	return
 }
 
 type pooledClient struct {
-	p *ClientPool
+	p     *ClientPool
+	entry *poolEntry
 	Client
 }
 
 func (pc *pooledClient) Close() {
-	c := pc.Client
-	if _, ok := c.(*errClient); ok {
+	if pc.entry == nil {
 		return
 	}
 
+	e := pc.entry
+	pc.entry = nil
 	pc.Client = &errClient{ErrClientClosed}
-	pc.p.put(c)
+	pc.p.put(e)
 }
 
 type errClient struct {
@@ -202,3 +619,79 @@ func (c *errClient) SendWithTimeout(context.Context, Message, time.Duration) err
 func (c *errClient) GetSession() *IoSession { return nil }
 func (c *errClient) IsClosed() bool         { return true }
 func (c *errClient) IsConnected() bool      { return false }
+
+type resolverClientFactory struct {
+	sync.RWMutex
+	factory  EndpointFactory
+	breakers *BreakerRegistry
+	addrs    []string
+	active   map[string]bool
+	next     uint64
+}
+
+func (f *resolverClientFactory) setAddrs(addrs []string) {
+	active := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		active[addr] = true
+	}
+
+	f.Lock()
+	f.addrs = addrs
+	f.active = active
+	f.Unlock()
+}
+
+func (f *resolverClientFactory) isActive(addr string) (active bool) {
+	f.RLock()
+	active = f.active[addr]
+	f.RUnlock()
+	return
+}
+
+func (f *resolverClientFactory) NewClient() (Client, error) {
+	f.RLock()
+	addrs := f.addrs
+	f.RUnlock()
+
+	if len(addrs) == 0 {
+		return nil, ErrNoEndpoint
+	}
+
+	var addr string
+	for i := 0; i < len(addrs); i++ {
+		addr = addrs[atomic.AddUint64(&f.next, 1)%uint64(len(addrs))]
+		if f.breakers == nil || !f.breakers.IsOpen(addr) {
+			break
+		}
+	}
+
+	c, err := f.factory.NewClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Dial(addr); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &endpointClient{Client: c, addr: addr, f: f}, nil
+}
+
+// endpointClient remembers which endpoint a pooled client is connected to.
+type endpointClient struct {
+	Client
+	addr string
+	f    *resolverClientFactory
+}
+
+// endpointAddr returns the address of a client created through Subscribe.
+func endpointAddr(c Client) string {
+	if ec, ok := c.(*endpointClient); ok {
+		return ec.addr
+	}
+	return ""
+}
+
+func isStaleClient(c Client) bool {
+	ec, ok := c.(*endpointClient)
+	return ok && !ec.f.isActive(ec.addr)
+}
@@ -0,0 +1,30 @@
+package knet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientPoolWithoutFactory(t *testing.T) {
+	startMemServer(t, "pool-late-factory", &echoHandler{}, nil)
+
+	p := NewClientPool(testContext(t), nil, ClientPoolConfig{IdleMin: 1, MaintainInterval: 10 * time.Millisecond})
+	defer p.Close()
+
+	// the maintenance runs a few times with no factory
+	time.Sleep(50 * time.Millisecond)
+	if stats := p.Stats(); stats.Open != 0 {
+		t.Fatalf("%d clients open without a factory", stats.Open)
+	}
+
+	var open int32
+	p.Subscribe(NewStaticResolver("pool-late-factory"), countingMemFactory(t, &open))
+
+	deadline := time.Now().Add(3 * time.Second)
+	for p.Stats().Idle != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle clients not filled once the factory is set: %+v", p.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,86 @@
+package knet
+
+import "fmt"
+
+// CloseCause is the category of the reason a session was closed.
+type CloseCause int
+
+const (
+	// CloseNone means the session is still open.
+	CloseNone CloseCause = iota
+	// ClosePeer means the peer closed the connection cleanly.
+	ClosePeer
+	// CloseIdle means OnIdle returned an error after a read timeout.
+	CloseIdle
+	// CloseDecode means the protocol failed to decode a message.
+	CloseDecode
+	// CloseEncode means the protocol failed to encode a message.
+	CloseEncode
+	// CloseIO means reading or writing the connection failed.
+	CloseIO
+	// CloseHandler means OnConnected or OnMessage returned an error.
+	CloseHandler
+	// CloseRateLimit means the session exceeded its read rate limits.
+	CloseRateLimit
+	// CloseOverload means the OverloadHandler returned an error.
+	CloseOverload
+	// ClosePanic means a handler or the protocol panicked.
+	ClosePanic
+	// CloseLocal means IoSession.Close was called.
+	CloseLocal
+	// CloseShutdown means the server or the client was closed.
+	CloseShutdown
+)
+
+var closeCauseNames = [...]string{
+	CloseNone:      "none",
+	ClosePeer:      "peer",
+	CloseIdle:      "idle",
+	CloseDecode:    "decode",
+	CloseEncode:    "encode",
+	CloseIO:        "io",
+	CloseHandler:   "handler",
+	CloseRateLimit: "rate_limit",
+	CloseOverload:  "overload",
+	ClosePanic:     "panic",
+	CloseLocal:     "local",
+	CloseShutdown:  "shutdown",
+}
+
+func (c CloseCause) String() string {
+	if c >= 0 && int(c) < len(closeCauseNames) {
+		return closeCauseNames[c]
+	}
+	return fmt.Sprintf("CloseCause(%d)", int(c))
+}
+
+// CloseInitiator tells which side closed a session.
+type CloseInitiator int
+
+const (
+	CloseByLocal CloseInitiator = iota
+	CloseByPeer
+)
+
+func (i CloseInitiator) String() string {
+	if i == CloseByPeer {
+		return "peer"
+	}
+	return "local"
+}
+
+// CloseReason tells why a session was closed. Err is the error which
+// caused it, nil for CloseLocal, CloseShutdown, and ClosePeer unless the
+// peer closed the connection in the middle of a message.
+type CloseReason struct {
+	Cause     CloseCause
+	Err       error
+	Initiator CloseInitiator
+}
+
+func (r CloseReason) String() string {
+	if r.Err == nil {
+		return fmt.Sprintf("%v (by %v)", r.Cause, r.Initiator)
+	}
+	return fmt.Sprintf("%v (by %v): %v", r.Cause, r.Initiator, r.Err)
+}
@@ -2,16 +2,47 @@ package knet
 
 import (
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type Conn struct {
+	// 64-bit atomic fields first, for alignment on 32-bit platforms
+	bytesIn   uint64
+	bytesOut  uint64
+	lastRead  int64
+	lastWrite int64
+	// readStart is the time of the first read since markRead
+	readStart int64
+
 	net.Conn
+	packet packetReader
+	// readErr is the last read error since markRead
+	readErr      error
 	readTimeout  time.Duration
 	writeTimeout time.Duration
-	bytesIn      uint32
-	bytesOut     uint32
+
+	// limits of the session, and of the whole service if global is set
+	local     bandwidth
+	global    *bandwidth
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(conn net.Conn) *Conn {
+	c := &Conn{
+		Conn:   conn,
+		closed: make(chan struct{}),
+	}
+
+	if pc := unwrapConn(conn, func(c net.Conn) bool {
+		_, ok := c.(packetReader)
+		return ok
+	}); pc != nil {
+		c.packet = pc.(packetReader)
+	}
+	return c
 }
 
 func (c *Conn) SetTimeout(d time.Duration) {
@@ -41,32 +72,195 @@ func (c *Conn) SetWriteTimeout(d time.Duration) (err error) {
 	return
 }
 
+// SetReadLimit limits the read bandwidth of the connection, it can be
+// changed at any time.
+func (c *Conn) SetReadLimit(l BandwidthLimit) {
+	c.local.read.set(l)
+}
+
+// SetWriteLimit limits the write bandwidth of the connection, it can be
+// changed at any time.
+func (c *Conn) SetWriteLimit(l BandwidthLimit) {
+	c.local.write.set(l)
+}
+
+func (c *Conn) ReadLimit() BandwidthLimit {
+	return c.local.read.limit()
+}
+
+func (c *Conn) WriteLimit() BandwidthLimit {
+	return c.local.write.limit()
+}
+
+func (c *Conn) readBuckets() (local, global *TokenBucket) {
+	local = c.local.read.bucket()
+	if c.global != nil {
+		global = c.global.read.bucket()
+	}
+	return
+}
+
+func (c *Conn) writeBuckets() (local, global *TokenBucket) {
+	local = c.local.write.bucket()
+	if c.global != nil {
+		global = c.global.write.bucket()
+	}
+	return
+}
+
+// throttle waits for d, or until the connection is closed.
+func (c *Conn) throttle(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-c.closed:
+	case <-timer.C:
+	}
+}
+
 func (c *Conn) Read(b []byte) (n int, err error) {
+	local, global := c.readBuckets()
+	b = b[:chunkSize(len(b), local, global)]
+
 	if c.readTimeout > 0 {
 		if err = c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
 			return
 		}
 	}
 	n, err = c.Conn.Read(b)
-	atomic.AddUint32(&c.bytesIn, uint32(n))
+	c.countRead(n)
+	if err != nil {
+		c.readErr = err
+	}
+
+	c.throttle(reserve(n, local, global))
+	return
+}
+
+// IsPacket reports whether the underlying connection is message oriented.
+func (c *Conn) IsPacket() bool {
+	return c.packet != nil
+}
+
+// ReadPacket reads one whole datagram from a message oriented connection.
+func (c *Conn) ReadPacket() (pkt []byte, err error) {
+	if c.readTimeout > 0 {
+		if err = c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return
+		}
+	}
+	pkt, err = c.packet.ReadPacket()
+	c.countRead(len(pkt))
+	if err != nil {
+		c.readErr = err
+	}
+
+	local, global := c.readBuckets()
+	c.throttle(reserve(len(pkt), local, global))
 	return
 }
 
 func (c *Conn) Write(b []byte) (n int, err error) {
+	local, global := c.writeBuckets()
+
+	// datagrams and websocket messages can't be split
+	if local == nil && global == nil || c.IsPacket() {
+		c.throttle(reserve(len(b), local, global))
+		return c.write(b)
+	}
+
+	for len(b) > 0 {
+		chunk := chunkSize(len(b), local, global)
+		c.throttle(reserve(chunk, local, global))
+
+		var nw int
+		nw, err = c.write(b[:chunk])
+		if n += nw; err != nil {
+			return
+		}
+		b = b[nw:]
+	}
+	return
+}
+
+func (c *Conn) write(b []byte) (n int, err error) {
 	if c.writeTimeout > 0 {
 		if err = c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
 			return
 		}
 	}
 	n, err = c.Conn.Write(b)
-	atomic.AddUint32(&c.bytesOut, uint32(n))
+
+	if n > 0 {
+		atomic.AddUint64(&c.bytesOut, uint64(n))
+		atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+	}
 	return
 }
 
-func (c *Conn) GetReadBytes() uint32 {
-	return atomic.LoadUint32(&c.bytesIn)
+func (c *Conn) countRead(n int) {
+	if n > 0 {
+		now := time.Now().UnixNano()
+		atomic.AddUint64(&c.bytesIn, uint64(n))
+		atomic.StoreInt64(&c.lastRead, now)
+		atomic.CompareAndSwapInt64(&c.readStart, 0, now)
+	}
+}
+
+// markRead starts timing the next read, see readSince, and clears the
+// last read error.
+func (c *Conn) markRead() {
+	atomic.StoreInt64(&c.readStart, 0)
+	c.readErr = nil
+}
+
+// readSince returns the time data was first read since markRead, zero if
+// none was.
+func (c *Conn) readSince() time.Time {
+	return unixNanoTime(atomic.LoadInt64(&c.readStart))
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *Conn) GetReadBytes() uint64 {
+	return atomic.LoadUint64(&c.bytesIn)
+}
+
+func (c *Conn) GetWriteBytes() uint64 {
+	return atomic.LoadUint64(&c.bytesOut)
+}
+
+// LastRead returns the time data was last read, zero if never.
+func (c *Conn) LastRead() time.Time {
+	return unixNanoTime(atomic.LoadInt64(&c.lastRead))
+}
+
+// LastWrite returns the time data was last written, zero if never.
+func (c *Conn) LastWrite() time.Time {
+	return unixNanoTime(atomic.LoadInt64(&c.lastWrite))
+}
+
+// isTimeout reports whether err is a timeout of a net.Conn operation.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func unixNanoTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
 }
 
-func (c *Conn) GetWriteBytes() uint32 {
-	return atomic.LoadUint32(&c.bytesOut)
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
 }
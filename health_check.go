@@ -0,0 +1,61 @@
+package knet
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrClientUnhealthy = errors.New("client unhealthy")
+
+// HealthChecker reports whether a client is still usable.
+type HealthChecker interface {
+	Check(ctx context.Context, c Client) error
+}
+
+type HealthCheckFunc func(ctx context.Context, c Client) error
+
+func (f HealthCheckFunc) Check(ctx context.Context, c Client) error {
+	return f(ctx, c)
+}
+
+// ConnectedHealthChecker only checks that the client session is alive.
+var ConnectedHealthChecker HealthChecker = HealthCheckFunc(checkConnected)
+
+func checkConnected(ctx context.Context, c Client) error {
+	if c.IsClosed() {
+		return ErrClientClosed
+	}
+	if !c.IsConnected() {
+		return ErrClientDisconnected
+	}
+	return nil
+}
+
+// ProbeHealthChecker calls the request returned by newProbe and considers
+// the client healthy if a response arrives within timeout.
+func ProbeHealthChecker(newProbe func() Request, timeout time.Duration) HealthChecker {
+	return HealthCheckFunc(func(ctx context.Context, c Client) (err error) {
+		if err = checkConnected(ctx, c); err != nil {
+			return
+		}
+
+		if _, err = c.CallWithTimeout(ctx, newProbe(), timeout); err != nil {
+			return
+		}
+		return
+	})
+}
+
+func runHealthCheck(ctx context.Context, checker HealthChecker, c Client, timeout time.Duration) error {
+	if checker == nil {
+		checker = ConnectedHealthChecker
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return checker.Check(ctx, c)
+}
@@ -0,0 +1,200 @@
+package knet
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memClientFactory creates the clients of a pool, connected to addr.
+type memClientFactory struct {
+	t    *testing.T
+	addr string
+}
+
+func (f *memClientFactory) NewClient() (Client, error) {
+	c := NewMemClient(testContext(f.t), NewMemClientConfig())
+	c.SetProtocol(testProto{})
+	if err := c.Dial(f.addr); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// switchChecker fails its checks while unhealthy is set.
+type switchChecker struct {
+	unhealthy int32
+}
+
+func (c *switchChecker) set(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&c.unhealthy, 0)
+	} else {
+		atomic.StoreInt32(&c.unhealthy, 1)
+	}
+}
+
+func (c *switchChecker) Check(ctx context.Context, client Client) error {
+	if atomic.LoadInt32(&c.unhealthy) == 1 {
+		return ErrClientUnhealthy
+	}
+	return checkConnected(ctx, client)
+}
+
+func waitPoolStats(t *testing.T, p *ClientPool, cond func(PoolStats) bool) PoolStats {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		stats := p.Stats()
+		if cond(stats) {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool stats = %+v", stats)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProbeHealthChecker(t *testing.T) {
+	startMemServer(t, "health-probe", &echoHandler{}, nil)
+	startMemServer(t, "health-mute", newRecordHandler(), nil)
+
+	checker := ProbeHealthChecker(func() Request { return &testMsg{id: 1} }, 50*time.Millisecond)
+
+	if err := checker.Check(context.Background(), dialMemClient(t, "health-probe")); err != nil {
+		t.Fatalf("Check() error = %v on an answering server", err)
+	}
+
+	if err := checker.Check(context.Background(), dialMemClient(t, "health-mute")); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Check() error = %v on a mute server, want %v", err, ErrTimeout)
+	}
+
+	closed := dialMemClient(t, "health-probe")
+	closed.Close()
+	if err := checker.Check(context.Background(), closed); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("Check() error = %v on a closed client, want %v", err, ErrClientClosed)
+	}
+}
+
+func TestClientPoolHealthCheck(t *testing.T) {
+	startMemServer(t, "health-pool", &echoHandler{}, nil)
+
+	checker := &switchChecker{}
+	p := NewClientPool(testContext(t), &memClientFactory{t: t, addr: "health-pool"}, ClientPoolConfig{
+		IdleMin:             2,
+		MaintainInterval:    time.Hour,
+		HealthCheckInterval: 10 * time.Millisecond,
+		HealthChecker:       checker,
+	})
+	defer p.Close()
+	if err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitPoolStats(t, p, func(s PoolStats) bool { return s.HealthChecks >= 4 })
+	if stats := p.Stats(); stats.Idle != 2 || stats.HealthCheckFailed != 0 || stats.Evicted != 0 {
+		t.Fatalf("stats = %+v with healthy clients", stats)
+	}
+
+	// the failing clients are evicted
+	checker.set(false)
+	stats := waitPoolStats(t, p, func(s PoolStats) bool { return s.Evicted == 2 })
+	if stats.Idle != 0 || stats.Open != 0 || stats.HealthCheckFailed < 2 {
+		t.Fatalf("stats = %+v after the clients failed, want them closed", stats)
+	}
+}
+
+func TestClientPoolTestOnBorrow(t *testing.T) {
+	startMemServer(t, "health-borrow", &echoHandler{}, nil)
+
+	checker := &switchChecker{}
+	p := NewClientPool(testContext(t), &memClientFactory{t: t, addr: "health-borrow"}, ClientPoolConfig{
+		MaintainInterval: time.Hour,
+		TestOnBorrow:     true,
+		HealthChecker:    checker,
+	})
+	defer p.Close()
+
+	c, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if stats := p.Stats(); stats.Idle != 1 {
+		t.Fatalf("stats = %+v, want the client idle", stats)
+	}
+
+	// the idle client fails its check, a new one is created
+	checker.set(false)
+	if c, err = p.Get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	stats := p.Stats()
+	if stats.Evicted != 1 || stats.HealthCheckFailed != 1 || stats.Created != 2 {
+		t.Fatalf("stats = %+v, want the idle client evicted and another created", stats)
+	}
+}
+
+func TestBalancedClientHealthCheck(t *testing.T) {
+	startMemServer(t, "health-bal-a", &echoHandler{}, nil)
+	startMemServer(t, "health-bal-b", &echoHandler{}, nil)
+
+	var (
+		open   int32
+		failed int32
+	)
+
+	// only the clients of b fail while failed is set
+	checker := HealthCheckFunc(func(ctx context.Context, c Client) error {
+		if atomic.LoadInt32(&failed) == 1 && c.GetSession().RemoteAddr().String() == "health-bal-b" {
+			return ErrClientUnhealthy
+		}
+		return checkConnected(ctx, c)
+	})
+
+	conf := NewBalancedClientConfig()
+	conf.EjectDuration = 100 * time.Millisecond
+	conf.HealthChecker = checker
+	conf.HealthCheckInterval = 10 * time.Millisecond
+	c := NewBalancedClient(testContext(t), countingMemFactory(t, &open), conf)
+	defer c.Close()
+
+	if err := c.Dial("health-bal-a,health-bal-b"); err != nil {
+		t.Fatal(err)
+	}
+	a, b := c.Endpoints()[0], c.Endpoints()[1]
+
+	atomic.StoreInt32(&failed, 1)
+	deadline := time.Now().Add(3 * time.Second)
+	for !b.IsEjected() || b.Client() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("failing endpoint not ejected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if a.IsEjected() || a.Client() == nil {
+		t.Fatal("healthy endpoint ejected")
+	}
+
+	// calls avoid the ejected endpoint
+	for i := uint64(1); i <= 10; i++ {
+		if _, err := c.Call(context.Background(), &testMsg{id: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// back from ejection, the endpoint is reconnected
+	atomic.StoreInt32(&failed, 0)
+	for b.Client() == nil || !b.Client().IsConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("endpoint not reconnected after ejection")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
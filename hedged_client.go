@@ -0,0 +1,341 @@
+package knet
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hedgeSource provides the clients for the attempts of a hedged call.
+// acquire avoids the clients used by the previous attempts when possible,
+// release must be called with the outcome of the attempt.
+type hedgeSource interface {
+	acquire(ctx context.Context, req Request, prev []Client) (client Client, release func(error), err error)
+}
+
+func (c *BalancedClient) acquire(ctx context.Context, req Request, prev []Client) (client Client, release func(error), err error) {
+	if c.IsClosed() {
+		return nil, nil, ErrClientClosed
+	}
+
+	ep := c.conf.Balancer.Pick(req, func(ep *Endpoint) bool {
+		if !c.available(ep) || (ep.limiter != nil && ep.limiter.Full()) {
+			return false
+		}
+		epClient := ep.Client()
+		for _, used := range prev {
+			if used == epClient {
+				return false
+			}
+		}
+		return true
+	})
+	if ep == nil {
+		return nil, nil, ErrNoEndpoint
+	}
+
+	if client = ep.Client(); client == nil {
+		return nil, nil, ErrNoEndpoint
+	}
+
+	limited := func(error) {}
+	if ep.limiter != nil {
+		if limited, err = ep.limiter.Acquire(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	done := func(error) {}
+	if c.conf.Breakers != nil {
+		if done, err = c.conf.Breakers.Allow(ep.Addr); err != nil {
+			limited(err)
+			return nil, nil, err
+		}
+	}
+
+	atomic.AddInt64(&ep.pending, 1)
+	release = func(err error) {
+		atomic.AddInt64(&ep.pending, -1)
+		limited(err)
+		done(err)
+		c.report(ep, err)
+	}
+	return
+}
+
+// poolClient adapts a ClientPool to the Client interface by borrowing a
+// client for every call.
+type poolClient struct {
+	p *ClientPool
+}
+
+func (c *poolClient) Dial(addr string) error   { return nil }
+func (c *poolClient) Close()                   { c.p.Close() }
+func (c *poolClient) Disconnect()              {}
+func (c *poolClient) SetProtocol(Protocol)     {}
+func (c *poolClient) SetIoHandler(IoHandler)   {}
+func (c *poolClient) GetSession() *IoSession   { return nil }
+func (c *poolClient) IsClosed() (closed bool)  { return c.p.isClosed() }
+func (c *poolClient) IsConnected() (conn bool) { return !c.p.isClosed() }
+
+func (c *poolClient) Call(ctx context.Context, req Request) (Response, error) {
+	return c.CallWithTimeout(ctx, req, 0)
+}
+
+func (c *poolClient) CallWithTimeout(ctx context.Context, req Request, timeout time.Duration) (Response, error) {
+	client, err := c.p.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return client.CallWithTimeout(ctx, req, timeout)
+}
+
+func (c *poolClient) Send(ctx context.Context, msg Message) error {
+	return c.SendWithTimeout(ctx, msg, 0)
+}
+
+func (c *poolClient) SendWithTimeout(ctx context.Context, msg Message, timeout time.Duration) error {
+	client, err := c.p.Get(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.SendWithTimeout(ctx, msg, timeout)
+}
+
+func (c *poolClient) acquire(ctx context.Context, req Request, prev []Client) (client Client, release func(error), err error) {
+	if client, err = c.p.Get(ctx); err != nil {
+		return nil, nil, err
+	}
+	return client, func(error) { client.Close() }, nil
+}
+
+const (
+	// hedgeDelayWarmup is the number of latencies observed before the delay
+	// adapts, or the window size if smaller.
+	hedgeDelayWarmup = 20
+	// hedgeDelayUpdateEvery is the number of latencies observed between two
+	// updates of the adaptive delay.
+	hedgeDelayUpdateEvery = 32
+)
+
+type HedgeConfig struct {
+	// Delay before sending a hedge, used until enough latencies are observed
+	// when Percentile is set.
+	Delay time.Duration
+	// Percentile makes the delay adaptive, e.g. 0.95 sends a hedge once the
+	// call is slower than 95% of the recent calls.
+	Percentile float64
+	// MinDelay is the lower bound of the adaptive delay.
+	MinDelay time.Duration
+	// MaxHedges is the number of extra copies sent at most.
+	MaxHedges int
+	// WindowSize is the number of recent latencies the percentile is
+	// computed over.
+	WindowSize int
+}
+
+func NewHedgeConfig() *HedgeConfig {
+	return &HedgeConfig{
+		Delay:      50 * time.Millisecond,
+		Percentile: 0.95,
+		MinDelay:   time.Millisecond,
+		MaxHedges:  1,
+		WindowSize: 1000,
+	}
+}
+
+type HedgeStats struct {
+	Calls       uint64
+	Hedges      uint64
+	HedgeWins   uint64
+	PrimaryWins uint64
+}
+
+// HedgedClient sends a second copy of a call to another endpoint when the
+// first one is slow, and takes whichever reply comes first, cancelling the
+// other. Only use it for read-only or idempotent requests.
+type HedgedClient struct {
+	// 64-bit atomic fields first, for alignment on 32-bit platforms
+	delay       int64
+	calls       uint64
+	hedges      uint64
+	hedgeWins   uint64
+	primaryWins uint64
+
+	conf   *HedgeConfig
+	source hedgeSource
+	Client
+
+	latencyLock sync.Mutex
+	latencies   []time.Duration
+	next        int
+	unsorted    int
+	adapted     bool
+}
+
+func NewHedgedClient(client *BalancedClient, conf *HedgeConfig) *HedgedClient {
+	return newHedgedClient(client, client, conf)
+}
+
+func NewHedgedPoolClient(pool *ClientPool, conf *HedgeConfig) *HedgedClient {
+	pc := &poolClient{p: pool}
+	return newHedgedClient(pc, pc, conf)
+}
+
+func newHedgedClient(client Client, source hedgeSource, conf *HedgeConfig) *HedgedClient {
+	if conf.WindowSize <= 0 {
+		conf.WindowSize = 1000
+	}
+
+	return &HedgedClient{
+		conf:   conf,
+		source: source,
+		Client: client,
+		delay:  int64(conf.Delay),
+	}
+}
+
+func (c *HedgedClient) Stats() HedgeStats {
+	return HedgeStats{
+		Calls:       atomic.LoadUint64(&c.calls),
+		Hedges:      atomic.LoadUint64(&c.hedges),
+		HedgeWins:   atomic.LoadUint64(&c.hedgeWins),
+		PrimaryWins: atomic.LoadUint64(&c.primaryWins),
+	}
+}
+
+// HedgeDelay returns the current delay before a hedge is sent.
+func (c *HedgedClient) HedgeDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.delay))
+}
+
+func (c *HedgedClient) Call(ctx context.Context, req Request) (Response, error) {
+	return c.CallWithTimeout(ctx, req, 0)
+}
+
+type hedgeResult struct {
+	attempt int
+	resp    Response
+	err     error
+}
+
+func (c *HedgedClient) CallWithTimeout(ctx context.Context, req Request, timeout time.Duration) (resp Response, err error) {
+	atomic.AddUint64(&c.calls, 1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		tBegin   = time.Now()
+		results  = make(chan hedgeResult, c.conf.MaxHedges+1)
+		used     []Client
+		inflight int
+		launched int
+	)
+
+	launch := func() bool {
+		client, release, err := c.source.acquire(ctx, req, used)
+		if err != nil {
+			if launched == 0 {
+				results <- hedgeResult{err: err}
+				inflight++
+				launched++
+			}
+			return false
+		}
+
+		used = append(used, client)
+		attempt := launched
+		inflight++
+		launched++
+
+		go func() {
+			resp, err := client.CallWithTimeout(ctx, req, timeout)
+			release(err)
+			results <- hedgeResult{attempt: attempt, resp: resp, err: err}
+		}()
+		return true
+	}
+
+	launch()
+
+	timer := time.NewTimer(c.HedgeDelay())
+	defer timer.Stop()
+
+	for inflight > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
+		case r := <-results:
+			inflight--
+
+			if r.err == nil {
+				c.observe(time.Since(tBegin))
+				if r.attempt > 0 {
+					atomic.AddUint64(&c.hedgeWins, 1)
+				} else {
+					atomic.AddUint64(&c.primaryWins, 1)
+				}
+				return r.resp, nil
+			}
+			err = r.err
+
+		case <-timer.C:
+			if launched <= c.conf.MaxHedges && launch() {
+				atomic.AddUint64(&c.hedges, 1)
+				timer.Reset(c.HedgeDelay())
+			}
+		}
+	}
+	return
+}
+
+// observe records the latency of a successful call. The adaptive delay is
+// recomputed every hedgeDelayUpdateEvery latencies, sorting the window on
+// every call would cost more than the hedging saves.
+func (c *HedgedClient) observe(latency time.Duration) {
+	if c.conf.Percentile <= 0 {
+		return
+	}
+
+	c.latencyLock.Lock()
+	if len(c.latencies) < c.conf.WindowSize {
+		c.latencies = append(c.latencies, latency)
+	} else {
+		c.latencies[c.next] = latency
+		c.next = (c.next + 1) % c.conf.WindowSize
+	}
+
+	// wait for a meaningful sample before adapting, then adapt in batches
+	warmup := hedgeDelayWarmup
+	if c.conf.WindowSize < warmup {
+		warmup = c.conf.WindowSize
+	}
+
+	c.unsorted++
+	if len(c.latencies) < warmup || (c.adapted && c.unsorted < hedgeDelayUpdateEvery) {
+		c.latencyLock.Unlock()
+		return
+	}
+	c.unsorted = 0
+	c.adapted = true
+
+	sorted := make([]time.Duration, len(c.latencies))
+	copy(sorted, c.latencies)
+	c.latencyLock.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	delay := sorted[int(float64(len(sorted)-1)*c.conf.Percentile)]
+	if delay < c.conf.MinDelay {
+		delay = c.conf.MinDelay
+	}
+	atomic.StoreInt64(&c.delay, int64(delay))
+}
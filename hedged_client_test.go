@@ -0,0 +1,75 @@
+package knet
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedgeDelayAdapts(t *testing.T) {
+	conf := NewHedgeConfig()
+	conf.Percentile = 0.5
+	c := newHedgedClient(nil, nil, conf)
+
+	delay := func() time.Duration { return time.Duration(atomic.LoadInt64(&c.delay)) }
+
+	for i := 0; i < 19; i++ {
+		c.observe(10 * time.Millisecond)
+	}
+	if delay() != conf.Delay {
+		t.Fatalf("delay = %v before enough latencies, want %v", delay(), conf.Delay)
+	}
+
+	c.observe(10 * time.Millisecond)
+	if delay() != 10*time.Millisecond {
+		t.Fatalf("delay = %v, want the median of the latencies", delay())
+	}
+
+	// slower calls move the delay only once a batch is observed
+	for i := 1; i < hedgeDelayUpdateEvery; i++ {
+		c.observe(30 * time.Millisecond)
+	}
+	if delay() != 10*time.Millisecond {
+		t.Fatalf("delay = %v, updated before the batch ended", delay())
+	}
+
+	c.observe(30 * time.Millisecond)
+	if delay() != 30*time.Millisecond {
+		t.Fatalf("delay = %v, want 30ms", delay())
+	}
+}
+
+func TestHedgeDelaySmallWindow(t *testing.T) {
+	for _, size := range []int{5, hedgeDelayWarmup} {
+		conf := NewHedgeConfig()
+		conf.Percentile = 0.5
+		conf.WindowSize = size
+		c := newHedgedClient(nil, nil, conf)
+
+		for i := 1; i < size; i++ {
+			c.observe(10 * time.Millisecond)
+		}
+		if d := c.HedgeDelay(); d != conf.Delay {
+			t.Fatalf("window %d: delay = %v before the window filled, want %v", size, d, conf.Delay)
+		}
+
+		// a window smaller than the warm up adapts once full
+		c.observe(10 * time.Millisecond)
+		if d := c.HedgeDelay(); d != 10*time.Millisecond {
+			t.Fatalf("window %d: delay = %v, want 10ms", size, d)
+		}
+
+		// a full window is still sorted once per batch only
+		for i := 1; i < hedgeDelayUpdateEvery; i++ {
+			c.observe(30 * time.Millisecond)
+		}
+		if d := c.HedgeDelay(); d != 10*time.Millisecond {
+			t.Fatalf("window %d: delay = %v, updated before the batch ended", size, d)
+		}
+
+		c.observe(30 * time.Millisecond)
+		if d := c.HedgeDelay(); d != 30*time.Millisecond {
+			t.Fatalf("window %d: delay = %v, want 30ms", size, d)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package knet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testContext returns a context canceled when the test ends.
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// testMsg is both the request and the response of testProto.
+type testMsg struct {
+	id         uint64
+	body       string
+	trace      string
+	idempotent bool
+}
+
+func (m *testMsg) Id() uint64 { return m.id }
+
+func (m *testMsg) Idempotent() bool { return m.idempotent }
+
+// testProto frames a testMsg as its id, the length of its body, the body,
+// the length of its trace header and the trace header.
+type testProto struct{}
+
+func (testProto) Decode(s *IoSession, r io.Reader) (Message, error) {
+	var h [12]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(h[8:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	trace := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, trace); err != nil {
+		return nil, err
+	}
+
+	return &testMsg{id: binary.BigEndian.Uint64(h[:]), body: string(body), trace: string(trace)}, nil
+}
+
+func (testProto) Encode(s *IoSession, m Message) ([]byte, error) {
+	msg, ok := m.(*testMsg)
+	if !ok {
+		return nil, errors.New("not a test message")
+	}
+
+	b := make([]byte, 12, 14+len(msg.body)+len(msg.trace))
+	binary.BigEndian.PutUint64(b, msg.id)
+	binary.BigEndian.PutUint32(b[8:], uint32(len(msg.body)))
+	b = append(b, msg.body...)
+	b = append(b, byte(len(msg.trace)>>8), byte(len(msg.trace)))
+	b = append(b, msg.trace...)
+	return b, nil
+}
+
+// MessageHeader carries the trace header of a testMsg.
+func (testProto) MessageHeader(m Message) MessageHeader {
+	return MapHeader{"trace": m.(*testMsg).trace}
+}
+
+func (p testProto) EncodeHeader(s *IoSession, m Message, h MessageHeader) ([]byte, error) {
+	msg, ok := m.(*testMsg)
+	if !ok {
+		return nil, errors.New("not a test message")
+	}
+
+	traced := *msg
+	traced.trace = h.Get("trace")
+	return p.Encode(s, &traced)
+}
+
+// echoHandler replies to every message with a copy of it.
+type echoHandler struct {
+	IoHandlerAdapter
+}
+
+func (h *echoHandler) OnMessage(s *IoSession, m Message) error {
+	msg := *m.(*testMsg)
+	return s.Send(s.MessageContext(), &msg)
+}
+
+// recordHandler records the close reasons of its sessions.
+type recordHandler struct {
+	IoHandlerAdapter
+	onConnected func(*IoSession) error
+	onIdle      func(*IoSession) error
+	onMessage   func(*IoSession, Message) error
+	closed      chan CloseReason
+
+	lock   sync.Mutex
+	errors []error
+}
+
+func newRecordHandler() *recordHandler {
+	return &recordHandler{closed: make(chan CloseReason, 16)}
+}
+
+func (h *recordHandler) OnConnected(s *IoSession) error {
+	if h.onConnected != nil {
+		return h.onConnected(s)
+	}
+	return nil
+}
+
+func (h *recordHandler) OnIdle(s *IoSession) error {
+	if h.onIdle != nil {
+		return h.onIdle(s)
+	}
+	return nil
+}
+
+func (h *recordHandler) OnMessage(s *IoSession, m Message) error {
+	if h.onMessage != nil {
+		return h.onMessage(s, m)
+	}
+	return nil
+}
+
+func (h *recordHandler) OnError(s *IoSession, err error) {
+	h.lock.Lock()
+	h.errors = append(h.errors, err)
+	h.lock.Unlock()
+}
+
+func (h *recordHandler) OnDisconnected(s *IoSession) {
+	h.closed <- s.CloseReason()
+}
+
+func (h *recordHandler) Errors() []error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]error(nil), h.errors...)
+}
+
+func (h *recordHandler) waitClosed(t *testing.T) CloseReason {
+	t.Helper()
+
+	select {
+	case r := <-h.closed:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed")
+	}
+	return CloseReason{}
+}
+
+// startMemServer serves h over testProto on the in-memory address addr.
+func startMemServer(t *testing.T, addr string, h IoHandler, conf *MemServerConfig) *MemServer {
+	t.Helper()
+
+	if conf == nil {
+		conf = NewMemServerConfig()
+	}
+
+	srv := NewMemServer(testContext(t), conf)
+	srv.SetProtocol(testProto{})
+	srv.SetIoHandler(h)
+
+	ln, err := MemListen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		srv.Serve(ln)
+		close(served)
+	}()
+
+	// Serve must be done accepting before Close waits for the sessions
+	t.Cleanup(func() {
+		ln.Close()
+		<-served
+		srv.Close()
+	})
+	return srv
+}
+
+// dialMemClient connects a testProto client to the in-memory address addr.
+func dialMemClient(t *testing.T, addr string) *MemClient {
+	t.Helper()
+
+	c := NewMemClient(testContext(t), NewMemClientConfig())
+	c.SetProtocol(testProto{})
+	if err := c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+type logRecord struct {
+	level Level
+	msg   string
+}
+
+// testLogger is installed once, before any session logs, and hands the
+// records to the capturing test, if any. SetLogger isn't meant to be
+// called with sessions running.
+var testLogger = &captureLogger{}
+
+func init() {
+	testLogger.Logger = defaultLogger
+	SetLogger(testLogger)
+}
+
+// captureLogger records the level and message of the records logged while
+// a test runs, and passes the other records to Logger.
+type captureLogger struct {
+	Logger
+
+	lock    sync.Mutex
+	capture *[]logRecord
+}
+
+// logCapture holds the records captured for a test.
+type logCapture struct {
+	records *[]logRecord
+}
+
+// captureLogs captures the records logged until the test ends.
+func captureLogs(t *testing.T) *logCapture {
+	records := &[]logRecord{}
+	testLogger.lock.Lock()
+	testLogger.capture = records
+	testLogger.lock.Unlock()
+
+	t.Cleanup(func() {
+		testLogger.lock.Lock()
+		testLogger.capture = nil
+		testLogger.lock.Unlock()
+	})
+	return &logCapture{records: records}
+}
+
+func (l *captureLogger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+func (l *captureLogger) Info(msg string, keyvals ...interface{})  { l.log(LevelInfo, msg, keyvals) }
+func (l *captureLogger) Warn(msg string, keyvals ...interface{})  { l.log(LevelWarn, msg, keyvals) }
+func (l *captureLogger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+func (l *captureLogger) log(level Level, msg string, keyvals []interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.capture != nil {
+		*l.capture = append(*l.capture, logRecord{level: level, msg: msg})
+		return
+	}
+
+	switch level {
+	case LevelDebug:
+		l.Logger.Debug(msg, keyvals...)
+	case LevelInfo:
+		l.Logger.Info(msg, keyvals...)
+	case LevelWarn:
+		l.Logger.Warn(msg, keyvals...)
+	default:
+		l.Logger.Error(msg, keyvals...)
+	}
+}
+
+// count returns the number of records captured at level with msg.
+func (c *logCapture) count(level Level, msg string) (n int) {
+	testLogger.lock.Lock()
+	defer testLogger.lock.Unlock()
+
+	for _, r := range *c.records {
+		if r.level == level && r.msg == msg {
+			n++
+		}
+	}
+	return
+}
@@ -1,12 +1,22 @@
 package knet
 
-import "sync/atomic"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 type IoServiceBase struct {
 	nextSessionId uint64
 	conf          *IoConfig
 	protocol      Protocol
 	handler       IoHandler
+
+	global       bandwidth
+	sessionLock  sync.RWMutex
+	sessionRead  BandwidthLimit
+	sessionWrite BandwidthLimit
+	metricsSink  Metrics
+	tracerSink   Tracer
 }
 
 func NewIoServiceBase(conf *IoConfig) *IoServiceBase {
@@ -41,6 +51,48 @@ func (srv *IoServiceBase) AddRef() {
 func (srv *IoServiceBase) DecRef() {
 }
 
+// SetBandwidth limits the aggregate bandwidth of all the sessions, it can
+// be changed at any time.
+func (srv *IoServiceBase) SetBandwidth(read, write BandwidthLimit) {
+	srv.global.read.set(read)
+	srv.global.write.set(write)
+}
+
+// SetSessionBandwidth sets the bandwidth limits of the new sessions, use
+// IoSession.SetBandwidth to change the limits of an open session.
+func (srv *IoServiceBase) SetSessionBandwidth(read, write BandwidthLimit) {
+	srv.sessionLock.Lock()
+	srv.sessionRead, srv.sessionWrite = read, write
+	srv.sessionLock.Unlock()
+}
+
+func (srv *IoServiceBase) bandwidth() (global *bandwidth, read, write BandwidthLimit) {
+	srv.sessionLock.RLock()
+	read, write = srv.sessionRead, srv.sessionWrite
+	srv.sessionLock.RUnlock()
+	return &srv.global, read, write
+}
+
+// SetMetrics makes the service report to m, it must be called before the
+// service is started.
+func (srv *IoServiceBase) SetMetrics(m Metrics) {
+	srv.metricsSink = m
+}
+
+func (srv *IoServiceBase) metrics() Metrics {
+	return srv.metricsSink
+}
+
+// SetTracer makes the service trace its messages with t, it must be called
+// before the service is started.
+func (srv *IoServiceBase) SetTracer(t Tracer) {
+	srv.tracerSink = t
+}
+
+func (srv *IoServiceBase) tracer() Tracer {
+	return srv.tracerSink
+}
+
 func (srv *IoServiceBase) NextSessionId() uint64 {
 	return atomic.AddUint64(&srv.nextSessionId, 1)
 }
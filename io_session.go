@@ -1,7 +1,10 @@
 package knet
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -17,8 +20,56 @@ var (
 	ErrTimeout       = errors.New("timeout")
 )
 
+// received is a message waiting in the receive queue.
+type received struct {
+	Message
+	ctx context.Context
+	at  time.Time
+}
+
+// messageContext wraps the context of the message being handled, for
+// storage in an atomic.Value.
+type messageContext struct {
+	ctx context.Context
+}
+
+// outgoing is a message waiting in the send queue, with the context it
+// was sent with.
+type outgoing struct {
+	Message
+	ctx context.Context
+}
+
+type SessionStats struct {
+	Id          uint64
+	CreatedAt   time.Time
+	BytesIn     uint64
+	BytesOut    uint64
+	MessagesIn  uint64
+	MessagesOut uint64
+	LastRead    time.Time
+	LastWrite   time.Time
+	// IdleCount is the number of read timeouts in a row, IdleTotal since
+	// the session was opened.
+	IdleCount    uint32
+	IdleTotal    uint64
+	SendQueueLen int
+	RecvQueueLen int
+	EncodeErrors uint64
+	// DecodeErrors includes the read errors other than EOF.
+	DecodeErrors uint64
+}
+
 type IoSession struct {
+	// 64-bit atomic fields first, for alignment on 32-bit platforms
+	readMsgCount  uint64
+	writeMsgCount uint64
+	idleTotal     uint64
+	encodeErrors  uint64
+	decodeErrors  uint64
+
 	id        uint64
+	createdAt time.Time
 	srv       IoService
 	conf      *IoConfig
 	handler   IoHandler
@@ -26,18 +77,22 @@ type IoSession struct {
 	conn      *Conn
 	attrs     map[interface{}]interface{}
 	attrsLock sync.RWMutex
-	sendQ     chan Message
-	recvQ     chan Message
+	sendQ     chan outgoing
+	recvQ     chan received
+	shedder   loadShedder
+	limiter   *sessionLimiter
+	metrics   Metrics
+	tracer    Tracer
+	msgCtx    atomic.Value
 
-	idleCount     uint32
-	readMsgCount  uint32
-	writeMsgCount uint32
+	idleCount uint32
 
 	ctx       context.Context
 	cancel    context.CancelFunc
 	wg        sync.WaitGroup
 	connected uint32
 	closed    uint32
+	reason    atomic.Value
 }
 
 func NewIoSession(ctx context.Context, srv IoService, conn net.Conn) *IoSession {
@@ -47,17 +102,41 @@ func NewIoSession(ctx context.Context, srv IoService, conn net.Conn) *IoSession
 	)
 
 	s := &IoSession{
-		id:       id,
-		srv:      srv,
-		handler:  srv.IoHandler(),
-		conf:     srv.IoConfig(),
-		protocol: srv.Protocol(),
-		conn:     &Conn{Conn: conn},
-		attrs:    make(map[interface{}]interface{}),
-		ctx:      newctx,
-		cancel:   cancel,
-		sendQ:    make(chan Message, srv.IoConfig().SendQueueSize),
-		recvQ:    make(chan Message, srv.IoConfig().RecvQueueSize),
+		id:        id,
+		createdAt: time.Now(),
+		srv:       srv,
+		handler:   srv.IoHandler(),
+		conf:      srv.IoConfig(),
+		protocol:  srv.Protocol(),
+		conn:      newConn(conn),
+		attrs:     make(map[interface{}]interface{}),
+		ctx:       newctx,
+		cancel:    cancel,
+		sendQ:     make(chan outgoing, srv.IoConfig().SendQueueSize),
+		recvQ:     make(chan received, srv.IoConfig().RecvQueueSize),
+	}
+
+	if sp, ok := srv.(shedderProvider); ok {
+		s.shedder = sp.shedder()
+	}
+
+	if bp, ok := srv.(bandwidthProvider); ok {
+		var read, write BandwidthLimit
+		s.conn.global, read, write = bp.bandwidth()
+		s.conn.SetReadLimit(read)
+		s.conn.SetWriteLimit(write)
+	}
+
+	if mp, ok := srv.(metricsProvider); ok {
+		s.metrics = mp.metrics()
+	}
+
+	if tp, ok := srv.(tracerProvider); ok {
+		s.tracer = tp.tracer()
+	}
+
+	if f, ok := srv.(sessionLimiterFactory); ok {
+		s.limiter = f.newSessionLimiter()
 	}
 
 	_ = s.conn.SetReadTimeout(s.conf.ReadTimeout)
@@ -78,6 +157,16 @@ func (s *IoSession) Context() context.Context {
 	return s.ctx
 }
 
+// MessageContext returns the context of the message being handled, which
+// carries its trace context, or the session context outside OnMessage.
+// Pass it to Send so that a reply is traced as part of the request.
+func (s *IoSession) MessageContext() context.Context {
+	if mc, _ := s.msgCtx.Load().(messageContext); mc.ctx != nil {
+		return mc.ctx
+	}
+	return s.ctx
+}
+
 func (s *IoSession) RemoteAddr() net.Addr {
 	return s.conn.RemoteAddr()
 }
@@ -86,6 +175,61 @@ func (s *IoSession) LocalAddr() net.Addr {
 	return s.conn.LocalAddr()
 }
 
+// ConnectionState returns the negotiated TLS state of the session.
+// ok is false if the session is not running over TLS.
+func (s *IoSession) ConnectionState() (state tls.ConnectionState, ok bool) {
+	if tc := tlsConnOf(s.conn); tc != nil {
+		return tc.ConnectionState(), true
+	}
+	return
+}
+
+// PeerCertificates returns the certificates presented by the peer, the
+// client identity when the server requires mutual TLS.
+func (s *IoSession) PeerCertificates() []*x509.Certificate {
+	state, ok := s.ConnectionState()
+	if !ok {
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+// PeerCred returns the credentials of the peer process for sessions
+// running over a unix socket.
+func (s *IoSession) PeerCred() (*PeerCred, error) {
+	uc := unixConnOf(s.conn)
+	if uc == nil {
+		return nil, ErrPeerCredNotSupported
+	}
+	return getPeerCred(uc)
+}
+
+// WebSocket returns the websocket connection of the session, or nil if the
+// session is not running over websocket.
+func (s *IoSession) WebSocket() *WSConn {
+	return wsConnOf(s.conn)
+}
+
+// ProxyHeader returns the PROXY protocol header the session was opened
+// with, or nil if there was none.
+func (s *IoSession) ProxyHeader() *ProxyHeader {
+	if pc := proxyConnOf(s.conn); pc != nil {
+		return pc.ProxyHeader()
+	}
+	return nil
+}
+
+// SetBandwidth changes the bandwidth limits of the session.
+func (s *IoSession) SetBandwidth(read, write BandwidthLimit) {
+	s.conn.SetReadLimit(read)
+	s.conn.SetWriteLimit(write)
+}
+
+// Bandwidth returns the bandwidth limits of the session.
+func (s *IoSession) Bandwidth() (read, write BandwidthLimit) {
+	return s.conn.ReadLimit(), s.conn.WriteLimit()
+}
+
 func (s *IoSession) GetAttr(key interface{}) (v interface{}) {
 	s.attrsLock.RLock()
 	v = s.attrs[key]
@@ -113,16 +257,41 @@ func (s *IoSession) Open() {
 	go s.writeLoop()
 	atomic.StoreUint32(&s.connected, 1)
 
+	defaultLogger.Debug("session opened", sessionFields(s, "local_addr", s.LocalAddr())...)
+
+	if s.metrics != nil {
+		s.metrics.SessionOpened(s)
+	}
+
 	if err := s.handler.OnConnected(s); err != nil {
-		s.Close()
+		s.closeWith(CloseReason{Cause: CloseHandler, Err: err})
 	}
 }
 
+// Close closes the session, with the CloseLocal reason.
 func (s *IoSession) Close() {
+	s.closeWith(CloseReason{Cause: CloseLocal})
+}
+
+// CloseReason returns why the session was closed, its Cause is CloseNone
+// while the session is open.
+func (s *IoSession) CloseReason() CloseReason {
+	r, _ := s.reason.Load().(CloseReason)
+	return r
+}
+
+// closeWith closes the session unless already closed, recording reason. A
+// loop ending without error was stopped by the service context.
+func (s *IoSession) closeWith(reason CloseReason) {
 	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
 		return
 	}
 
+	if reason.Cause == CloseNone {
+		reason.Cause = CloseShutdown
+	}
+	s.reason.Store(reason)
+
 	atomic.StoreUint32(&s.connected, 0)
 	s.cancel()
 	s.conn.Close()
@@ -130,9 +299,31 @@ func (s *IoSession) Close() {
 	go func() {
 		s.wg.Wait()
 
-		close(s.sendQ)
+		// the send queue is left open, a concurrent Send could pick it
+		// over the done context and panic
 		close(s.recvQ)
 
+		// release the messages admitted but never handled
+		if s.shedder != nil {
+			for range s.recvQ {
+				s.shedder.release()
+			}
+		}
+
+		reason := s.CloseReason()
+		defaultLogger.Debug("session closed", sessionFields(s,
+			"cause", reason.Cause,
+			"initiator", reason.Initiator,
+			"error", reason.Err,
+			"duration", time.Since(s.createdAt),
+			"bytes_in", s.conn.GetReadBytes(),
+			"bytes_out", s.conn.GetWriteBytes(),
+		)...)
+
+		if s.metrics != nil {
+			s.metrics.SessionClosed(s)
+		}
+
 		s.handler.OnDisconnected(s)
 		s.srv.DecRef()
 	}()
@@ -151,13 +342,19 @@ func (s *IoSession) Send(ctx context.Context, m Message) error {
 }
 
 func (s *IoSession) SendWithTimeout(ctx context.Context, m Message, timeout time.Duration) error {
+	// select picks at random among ready cases, don't queue on a closed
+	// session with room left in its queue
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+
 	if timeout == 0 {
 		select {
 		case <-s.ctx.Done():
 			return ErrSessionClosed
 		case <-ctx.Done():
 			return ctx.Err()
-		case s.sendQ <- m:
+		case s.sendQ <- outgoing{m, ctx}:
 		}
 	} else {
 		select {
@@ -167,10 +364,11 @@ func (s *IoSession) SendWithTimeout(ctx context.Context, m Message, timeout time
 			return ctx.Err()
 		case <-time.After(timeout):
 			return ErrTimeout
-		case s.sendQ <- m:
+		case s.sendQ <- outgoing{m, ctx}:
 		}
 	}
 
+	markSent(ctx)
 	return nil
 }
 
@@ -183,28 +381,52 @@ func (s *IoSession) String() string {
 		s.id,
 		s.conn.GetReadBytes(),
 		s.conn.GetWriteBytes(),
-		atomic.LoadUint32(&s.readMsgCount),
-		atomic.LoadUint32(&s.writeMsgCount),
+		atomic.LoadUint64(&s.readMsgCount),
+		atomic.LoadUint64(&s.writeMsgCount),
 	)
 }
 
+// Stats returns a snapshot of the session counters.
+func (s *IoSession) Stats() SessionStats {
+	return SessionStats{
+		Id:           s.id,
+		CreatedAt:    s.createdAt,
+		BytesIn:      s.conn.GetReadBytes(),
+		BytesOut:     s.conn.GetWriteBytes(),
+		MessagesIn:   atomic.LoadUint64(&s.readMsgCount),
+		MessagesOut:  atomic.LoadUint64(&s.writeMsgCount),
+		LastRead:     s.conn.LastRead(),
+		LastWrite:    s.conn.LastWrite(),
+		IdleCount:    atomic.LoadUint32(&s.idleCount),
+		IdleTotal:    atomic.LoadUint64(&s.idleTotal),
+		SendQueueLen: len(s.sendQ),
+		RecvQueueLen: len(s.recvQ),
+		EncodeErrors: atomic.LoadUint64(&s.encodeErrors),
+		DecodeErrors: atomic.LoadUint64(&s.decodeErrors),
+	}
+}
+
 func (s *IoSession) handleLoop() {
 	var (
-		m   Message
+		r   received
 		err error
 	)
 
 	defer func() {
+		cause := CloseHandler
 		if r := recover(); r != nil {
 			err = fmt.Errorf("got panic in handle loop: error=%v, stack=%v", r, getPanicStack())
+			cause = ClosePanic
 		}
 
 		if err != nil {
 			s.handler.OnError(s, err)
+		} else {
+			cause = CloseNone
 		}
 
 		s.wg.Done()
-		s.Close()
+		s.closeWith(CloseReason{Cause: cause, Err: err})
 	}()
 
 	for {
@@ -212,31 +434,72 @@ func (s *IoSession) handleLoop() {
 		case <-s.ctx.Done():
 			return
 
-		case m = <-s.recvQ:
-			if err = s.handler.OnMessage(s, m); err != nil {
+		case r = <-s.recvQ:
+			if err = s.handleMessage(r); err != nil {
 				return
 			}
 		}
 	}
 }
 
+func (s *IoSession) handleMessage(r received) error {
+	var (
+		tBegin = time.Now()
+		queued = tBegin.Sub(r.at)
+	)
+
+	if s.shedder != nil {
+		defer s.shedder.done(queued)
+	}
+
+	if s.metrics != nil {
+		defer func() { s.metrics.MessageHandled(s, queued, time.Since(tBegin)) }()
+	}
+
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = s.ctx
+	}
+
+	var span Span
+	if s.tracer != nil {
+		ctx, span = s.tracer.StartSpan(ctx, SpanHandle, tBegin, s, r.Message)
+	}
+
+	s.msgCtx.Store(messageContext{ctx})
+	defer s.msgCtx.Store(messageContext{})
+
+	err := s.handler.OnMessage(s, r.Message)
+	if span != nil {
+		span.End(err)
+	}
+	return err
+}
+
 func (s *IoSession) readLoop() {
 	var (
-		m   Message
-		err error
+		m      Message
+		ctx    context.Context
+		err    error
+		reason CloseReason
 	)
 
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("got panic in read loop: error=%v, stack=%v", r, getPanicStack())
+			reason = CloseReason{Cause: ClosePanic}
 		}
 
 		if !s.IsClosed() && err != nil && err != io.EOF {
 			s.handler.OnError(s, err)
 		}
 
+		if err != io.EOF {
+			reason.Err = err
+		}
+
 		s.wg.Done()
-		s.Close()
+		s.closeWith(reason)
 	}()
 
 	for {
@@ -247,62 +510,151 @@ func (s *IoSession) readLoop() {
 		default:
 		}
 
-		if m, err = s.protocol.Decode(s, s.conn); err != nil {
+		s.conn.markRead()
+
+		if m, err = s.decode(); err != nil {
 			if e, ok := err.(net.Error); ok && e.Timeout() {
 				atomic.AddUint32(&s.idleCount, 1)
+				atomic.AddUint64(&s.idleTotal, 1)
 
 				if err = s.handler.OnIdle(s); err != nil {
+					reason.Cause = CloseIdle
 					return
 				}
 
 				continue
 			}
+
+			if err != io.EOF && !s.IsClosed() {
+				atomic.AddUint64(&s.decodeErrors, 1)
+
+				// a connection reset is routine, a malformed message is not
+				if s.conn.readErr != nil {
+					defaultLogger.Debug("read failed", sessionFields(s, "error", err)...)
+				} else {
+					defaultLogger.Warn("decode failed", sessionFields(s, "error", err)...)
+				}
+
+				if s.tracer != nil {
+					s.traceDecode(s.conn.readSince(), nil, err)
+				}
+			}
+
+			switch {
+			case err == io.EOF || errors.Is(s.conn.readErr, io.EOF):
+				reason = CloseReason{Cause: ClosePeer, Initiator: CloseByPeer}
+			case s.conn.readErr != nil:
+				reason.Cause = CloseIO
+			default:
+				reason.Cause = CloseDecode
+			}
 			return
 		}
 
+		ctx = s.ctx
+		if s.tracer != nil {
+			ctx = s.traceDecode(s.conn.readSince(), m, nil)
+		}
+
 		atomic.StoreUint32(&s.idleCount, 0)
-		atomic.AddUint32(&s.readMsgCount, 1)
+		atomic.AddUint64(&s.readMsgCount, 1)
+
+		if s.limiter != nil {
+			var ok bool
+			if ok, err = s.limiter.check(s); err != nil {
+				reason.Cause = CloseRateLimit
+				return
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		if s.shedder != nil {
+			var admitted bool
+			if admitted, err = s.shedder.admit(s, m); err != nil {
+				reason.Cause = CloseOverload
+				return
+			}
+			if !admitted {
+				continue
+			}
+		}
 
 		select {
 		case <-s.ctx.Done():
-		case s.recvQ <- m:
+			if s.shedder != nil {
+				s.shedder.release()
+			}
+		case s.recvQ <- received{Message: m, ctx: ctx, at: time.Now()}:
 		}
 	}
 }
 
+func (s *IoSession) decode() (m Message, err error) {
+	if !s.conn.IsPacket() {
+		return s.protocol.Decode(s, s.conn)
+	}
+
+	var pkt []byte
+	if pkt, err = s.conn.ReadPacket(); err != nil {
+		return
+	}
+	return s.protocol.Decode(s, bytes.NewReader(pkt))
+}
+
 func (s *IoSession) writeLoop() {
 	var (
-		m    Message
-		data []byte
-		err  error
+		o     outgoing
+		cause CloseCause
+		err   error
 	)
 
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("got panic in write loop: error=%v, stack=%v", r, getPanicStack())
+			cause = ClosePanic
 		}
 
-		if !s.IsClosed() && err != nil {
+		if err == nil {
+			cause = CloseNone
+		} else if !s.IsClosed() {
 			s.handler.OnError(s, err)
 		}
 
 		s.wg.Done()
-		s.Close()
+		s.closeWith(CloseReason{Cause: cause, Err: err})
 	}()
 
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
-		case m = <-s.sendQ:
-			if data, err = s.protocol.Encode(s, m); err != nil {
-				return
-			}
-
-			if _, err = s.conn.Write(data); err != nil {
+		case o = <-s.sendQ:
+			if cause, err = s.write(o); err != nil {
 				return
 			}
-			atomic.AddUint32(&s.writeMsgCount, 1)
+			atomic.AddUint64(&s.writeMsgCount, 1)
 		}
 	}
 }
+
+// write encodes and writes o, cause tells which of the two failed.
+func (s *IoSession) write(o outgoing) (cause CloseCause, err error) {
+	ctx := o.ctx
+	if s.tracer != nil {
+		var span Span
+		ctx, span = s.tracer.StartSpan(ctx, SpanWrite, time.Now(), s, o.Message)
+		defer func() { span.End(err) }()
+	}
+
+	var data []byte
+	if data, err = s.encode(ctx, o.Message); err != nil {
+		atomic.AddUint64(&s.encodeErrors, 1)
+		defaultLogger.Warn("encode failed", sessionFields(s, "error", err)...)
+		return CloseEncode, err
+	}
+
+	_, err = s.conn.Write(data)
+	return CloseIO, err
+}
@@ -0,0 +1,234 @@
+package knet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSendAfterClose(t *testing.T) {
+	h := newRecordHandler()
+	startMemServer(t, "session-send-closed", h, nil)
+
+	c := dialMemClient(t, "session-send-closed")
+	s := c.GetSession()
+	s.Close()
+	h.waitClosed(t)
+
+	// let the session finish closing
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		if err := s.Send(context.Background(), &testMsg{id: uint64(i)}); err != ErrSessionClosed {
+			t.Fatalf("Send() after Close error = %v, want %v", err, ErrSessionClosed)
+		}
+	}
+}
+
+// strictProto rejects the messages whose body is "malformed".
+type strictProto struct {
+	testProto
+}
+
+func (p strictProto) Decode(s *IoSession, r io.Reader) (Message, error) {
+	m, err := p.testProto.Decode(s, r)
+	if err == nil && m.(*testMsg).body == "malformed" {
+		return nil, errors.New("malformed message")
+	}
+	return m, err
+}
+
+func TestDecodeErrorLogLevel(t *testing.T) {
+	h := newRecordHandler()
+	srv := startMemServer(t, "session-decode-log", h, nil)
+	srv.SetProtocol(strictProto{})
+	logs := captureLogs(t)
+
+	// a peer going away in the middle of a message is routine
+	conn, err := MemDial("session-decode-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{0, 0, 0, 1})
+	conn.Close()
+	h.waitClosed(t)
+
+	if n := logs.count(LevelWarn, "decode failed"); n != 0 {
+		t.Fatalf("%d decode warnings for a peer reset, want 0", n)
+	}
+	if n := logs.count(LevelDebug, "read failed"); n != 1 {
+		t.Fatalf("%d read failure debug records, want 1", n)
+	}
+
+	// a malformed message is worth a warning
+	conn, err = MemDial("session-decode-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	b, _ := testProto{}.Encode(nil, &testMsg{id: 1, body: "malformed"})
+	conn.Write(b)
+	h.waitClosed(t)
+
+	if n := logs.count(LevelWarn, "decode failed"); n != 1 {
+		t.Fatalf("%d decode warnings, want 1", n)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	errRefused := errors.New("refused")
+
+	expect := func(t *testing.T, got CloseReason, cause CloseCause, by CloseInitiator, err error) {
+		t.Helper()
+
+		if got.Cause != cause || got.Initiator != by {
+			t.Fatalf("close reason = %v, want %v (by %v)", got, cause, by)
+		}
+		if err != nil && !errors.Is(got.Err, err) {
+			t.Fatalf("close error = %v, want %v", got.Err, err)
+		}
+		if err == nil && (cause == ClosePeer || cause == CloseShutdown) && got.Err != nil {
+			t.Fatalf("close error = %v, want nil", got.Err)
+		}
+	}
+
+	t.Run("peer", func(t *testing.T) {
+		h := newRecordHandler()
+		startMemServer(t, "close-peer", h, nil)
+
+		c := dialMemClient(t, "close-peer")
+		c.GetSession().Close()
+		expect(t, h.waitClosed(t), ClosePeer, CloseByPeer, nil)
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		h := newRecordHandler()
+		h.onIdle = func(*IoSession) error { return errRefused }
+
+		conf := NewMemServerConfig()
+		conf.Io.ReadTimeout = 20 * time.Millisecond
+		startMemServer(t, "close-idle", h, conf)
+
+		dialMemClient(t, "close-idle")
+		expect(t, h.waitClosed(t), CloseIdle, CloseByLocal, errRefused)
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		h := newRecordHandler()
+		srv := startMemServer(t, "close-decode", h, nil)
+		srv.SetProtocol(strictProto{})
+
+		conn, err := MemDial("close-decode")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		b, _ := testProto{}.Encode(nil, &testMsg{id: 1, body: "malformed"})
+		conn.Write(b)
+
+		r := h.waitClosed(t)
+		expect(t, r, CloseDecode, CloseByLocal, nil)
+		if r.Err == nil {
+			t.Fatal("decode close without an error")
+		}
+	})
+
+	t.Run("handler", func(t *testing.T) {
+		h := newRecordHandler()
+		h.onConnected = func(*IoSession) error { return errRefused }
+		startMemServer(t, "close-handler", h, nil)
+
+		dialMemClient(t, "close-handler")
+		expect(t, h.waitClosed(t), CloseHandler, CloseByLocal, errRefused)
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		h := newRecordHandler()
+		startMemServer(t, "close-shutdown", h, nil)
+
+		c := dialMemClient(t, "close-shutdown")
+		s := c.GetSession()
+		c.Close()
+
+		expect(t, s.CloseReason(), CloseShutdown, CloseByLocal, nil)
+		expect(t, h.waitClosed(t), ClosePeer, CloseByPeer, nil)
+	})
+}
+
+func TestSessionStats(t *testing.T) {
+	sessions := make(chan *IoSession, 1)
+	h := newRecordHandler()
+	h.onConnected = func(s *IoSession) error {
+		sessions <- s
+		return nil
+	}
+	h.onMessage = func(s *IoSession, m Message) error {
+		msg := *m.(*testMsg)
+		if msg.body == "unencodable" {
+			return s.Send(s.MessageContext(), msg.body)
+		}
+		return s.Send(s.MessageContext(), &msg)
+	}
+	srv := startMemServer(t, "session-stats", h, nil)
+
+	c := dialMemClient(t, "session-stats")
+	server := <-sessions
+
+	var size uint64
+	for i, body := range []string{"a", "bb", "ccc"} {
+		if _, err := c.Call(context.Background(), &testMsg{id: uint64(i + 1), body: body}); err != nil {
+			t.Fatal(err)
+		}
+		size += uint64(14 + len(body))
+	}
+
+	want := SessionStats{BytesIn: size, BytesOut: size, MessagesIn: 3, MessagesOut: 3}
+	// a message is counted once written, which may be after the peer read it
+	check := func(who string, s *IoSession, want SessionStats) {
+		t.Helper()
+
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			got := s.Stats()
+			if got.BytesIn == want.BytesIn && got.BytesOut == want.BytesOut &&
+				got.MessagesIn == want.MessagesIn && got.MessagesOut == want.MessagesOut &&
+				got.EncodeErrors == want.EncodeErrors && got.DecodeErrors == want.DecodeErrors {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s stats = %+v, want %+v", who, got, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	check("client", c.GetSession(), want)
+	check("server", server, want)
+
+	// the reply to this one can't be encoded
+	if err := c.Send(context.Background(), &testMsg{id: 4, body: "unencodable"}); err != nil {
+		t.Fatal(err)
+	}
+	h.waitClosed(t)
+
+	want.BytesIn += 14 + uint64(len("unencodable"))
+	want.MessagesIn++
+	want.EncodeErrors++
+	check("server", server, want)
+
+	// a malformed message
+	srv.SetProtocol(strictProto{})
+	c = dialMemClient(t, "session-stats")
+	server = <-sessions
+
+	if err := c.Send(context.Background(), &testMsg{id: 1, body: "malformed"}); err != nil {
+		t.Fatal(err)
+	}
+	h.waitClosed(t)
+
+	want = SessionStats{BytesIn: 14 + uint64(len("malformed")), DecodeErrors: 1}
+	check("server", server, want)
+}
@@ -40,3 +40,7 @@ func (l *limitListenerConn) Close() error {
 	l.releaseOnce.Do(l.release)
 	return err
 }
+
+func (l *limitListenerConn) NetConn() net.Conn {
+	return l.Conn
+}
@@ -0,0 +1,308 @@
+package knet
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var ErrLimitExceeded = errors.New("concurrency limit exceeded")
+
+// LimitAlgorithm computes the concurrency limit of a Limiter from the
+// requests completing. Update is called with the round trip time of a
+// request, the number of requests in flight when it was issued and whether
+// it was dropped (timed out), and returns the new limit.
+type LimitAlgorithm interface {
+	Limit() int
+	Update(rtt time.Duration, inflight int, dropped bool) int
+}
+
+type fixedLimit int
+
+// NewFixedLimit never changes the limit.
+func NewFixedLimit(limit int) LimitAlgorithm {
+	return fixedLimit(limit)
+}
+
+func (l fixedLimit) Limit() int                          { return int(l) }
+func (l fixedLimit) Update(time.Duration, int, bool) int { return int(l) }
+
+// AIMDLimit grows the limit by one while requests are served within
+// Timeout and the limit is in use, and shrinks it by the Backoff factor on
+// drops.
+type AIMDLimit struct {
+	sync.Mutex
+	MinLimit int
+	MaxLimit int
+	Backoff  float64
+	Timeout  time.Duration
+	limit    int
+}
+
+func NewAIMDLimit(initial int) *AIMDLimit {
+	return &AIMDLimit{
+		MinLimit: 1,
+		MaxLimit: 1000,
+		Backoff:  0.9,
+		Timeout:  5 * time.Second,
+		limit:    initial,
+	}
+}
+
+func (l *AIMDLimit) Limit() (limit int) {
+	l.Lock()
+	limit = l.limit
+	l.Unlock()
+	return
+}
+
+func (l *AIMDLimit) Update(rtt time.Duration, inflight int, dropped bool) int {
+	l.Lock()
+	defer l.Unlock()
+
+	switch {
+	case dropped || (l.Timeout > 0 && rtt > l.Timeout):
+		if l.limit = int(float64(l.limit) * l.Backoff); l.limit < l.MinLimit {
+			l.limit = l.MinLimit
+		}
+	case inflight*2 >= l.limit && l.limit < l.MaxLimit:
+		l.limit++
+	}
+	return l.limit
+}
+
+// GradientLimit adjusts the limit by the ratio of the long term to the
+// recent latency, allowing a queue of sqrt(limit) requests. The limit
+// shrinks as soon as latency rises above its usual level, before requests
+// start to time out.
+type GradientLimit struct {
+	sync.Mutex
+	MinLimit int
+	MaxLimit int
+	// Smoothing weighs each new estimate into the limit.
+	Smoothing float64
+	// LongWindow is the number of samples the long term latency averages.
+	LongWindow int
+	limit      float64
+	longRTT    float64
+	shortRTT   float64
+}
+
+func NewGradientLimit(initial int) *GradientLimit {
+	return &GradientLimit{
+		MinLimit:   1,
+		MaxLimit:   1000,
+		Smoothing:  0.2,
+		LongWindow: 600,
+		limit:      float64(initial),
+	}
+}
+
+func (l *GradientLimit) Limit() (limit int) {
+	l.Lock()
+	limit = int(l.limit)
+	l.Unlock()
+	return
+}
+
+func (l *GradientLimit) Update(rtt time.Duration, inflight int, dropped bool) int {
+	l.Lock()
+	defer l.Unlock()
+
+	// a request without a measured latency tells nothing unless dropped
+	if rtt <= 0 && !dropped {
+		return int(l.limit)
+	}
+
+	if rtt > 0 {
+		window := float64(l.LongWindow)
+		if window < 1 {
+			window = 1
+		}
+
+		sample := float64(rtt)
+		if l.longRTT == 0 {
+			l.longRTT, l.shortRTT = sample, sample
+		}
+		l.longRTT += (sample - l.longRTT) / window
+		l.shortRTT += (sample - l.shortRTT) / 10
+	}
+
+	// don't grow while the limit isn't used
+	if !dropped && float64(inflight) < l.limit/2 {
+		return int(l.limit)
+	}
+
+	gradient := math.Max(0.5, math.Min(1, l.longRTT/l.shortRTT))
+	if dropped {
+		gradient = 0.5
+	} else if math.IsNaN(gradient) {
+		gradient = 1
+	}
+
+	estimate := l.limit*gradient + math.Sqrt(l.limit)
+	if l.limit = l.limit*(1-l.Smoothing) + estimate*l.Smoothing; math.IsNaN(l.limit) {
+		l.limit = float64(l.MinLimit)
+	}
+	l.limit = math.Max(float64(l.MinLimit), math.Min(float64(l.MaxLimit), l.limit))
+	return int(l.limit)
+}
+
+// Limiter caps the requests in flight, queueing the callers above the
+// limit in FIFO order.
+type Limiter struct {
+	sync.Mutex
+	algo     LimitAlgorithm
+	limit    int
+	inflight int
+	maxQueue int
+	waiters  list.List
+}
+
+// NewLimiter creates a limiter, maxQueue caps the waiting callers, 0
+// means no limit and a negative value rejects instead of queueing.
+func NewLimiter(algo LimitAlgorithm, maxQueue int) *Limiter {
+	return &Limiter{
+		algo:     algo,
+		limit:    algo.Limit(),
+		maxQueue: maxQueue,
+	}
+}
+
+func (l *Limiter) Limit() (limit int) {
+	l.Lock()
+	limit = l.limit
+	l.Unlock()
+	return
+}
+
+func (l *Limiter) Inflight() (n int) {
+	l.Lock()
+	n = l.inflight
+	l.Unlock()
+	return
+}
+
+// Full reports whether a new request would have to wait.
+func (l *Limiter) Full() (full bool) {
+	l.Lock()
+	full = l.inflight >= l.limit
+	l.Unlock()
+	return
+}
+
+// Acquire takes a slot, waiting for one until ctx is done. done must be
+// called with the outcome of the request.
+func (l *Limiter) Acquire(ctx context.Context) (done func(err error), err error) {
+	l.Lock()
+
+	if l.inflight < l.limit && l.waiters.Len() == 0 {
+		l.inflight++
+		inflight := l.inflight
+		l.Unlock()
+		return l.doneFunc(inflight), nil
+	}
+
+	if l.maxQueue < 0 || (l.maxQueue > 0 && l.waiters.Len() >= l.maxQueue) {
+		l.Unlock()
+		return nil, ErrLimitExceeded
+	}
+
+	ch := make(chan int, 1)
+	elem := l.waiters.PushBack(ch)
+	l.Unlock()
+
+	select {
+	case inflight := <-ch:
+		return l.doneFunc(inflight), nil
+	case <-ctx.Done():
+	}
+
+	l.Lock()
+	if elem.Value != nil {
+		l.waiters.Remove(elem)
+		elem.Value = nil
+		l.Unlock()
+		return nil, ctx.Err()
+	}
+	l.Unlock()
+
+	// we were granted a slot while giving up, give it back
+	<-ch
+	l.release()
+	return nil, ctx.Err()
+}
+
+func (l *Limiter) doneFunc(inflight int) func(err error) {
+	tBegin := time.Now()
+
+	return func(err error) {
+		var (
+			rtt     = time.Since(tBegin)
+			dropped = errors.Is(err, ErrTimeout) || errors.Is(err, context.DeadlineExceeded)
+		)
+
+		// other failures say nothing about the latency
+		if err == nil || dropped {
+			limit := l.algo.Update(rtt, inflight, dropped)
+			l.Lock()
+			l.limit = limit
+			l.Unlock()
+		}
+		l.release()
+	}
+}
+
+// release frees a slot and hands the free slots to the waiters.
+func (l *Limiter) release() {
+	l.Lock()
+	defer l.Unlock()
+
+	l.inflight--
+
+	for l.inflight < l.limit && l.waiters.Len() > 0 {
+		elem := l.waiters.Front()
+		l.waiters.Remove(elem)
+		ch := elem.Value.(chan int)
+		elem.Value = nil
+
+		l.inflight++
+		ch <- l.inflight
+	}
+}
+
+// BulkheadClient caps the calls in flight on a client.
+type BulkheadClient struct {
+	limiter *Limiter
+	Client
+}
+
+func NewBulkheadClient(client Client, limiter *Limiter) *BulkheadClient {
+	return &BulkheadClient{
+		Client:  client,
+		limiter: limiter,
+	}
+}
+
+func (c *BulkheadClient) Limiter() *Limiter {
+	return c.limiter
+}
+
+func (c *BulkheadClient) Call(ctx context.Context, req Request) (Response, error) {
+	return c.CallWithTimeout(ctx, req, 0)
+}
+
+func (c *BulkheadClient) CallWithTimeout(ctx context.Context, req Request, timeout time.Duration) (resp Response, err error) {
+	var done func(error)
+
+	if done, err = c.limiter.Acquire(ctx); err != nil {
+		return
+	}
+
+	resp, err = c.Client.CallWithTimeout(ctx, req, timeout)
+	done(err)
+	return
+}
@@ -0,0 +1,212 @@
+package knet
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGradientLimitZeroRTT(t *testing.T) {
+	l := NewGradientLimit(10)
+
+	for i := 0; i < 10; i++ {
+		if got := l.Update(0, 10, false); got != 10 {
+			t.Fatalf("Update(0) = %d, want the limit unchanged", got)
+		}
+	}
+
+	if got := l.Update(10*time.Millisecond, 10, false); got < 10 {
+		t.Fatalf("Update() = %d after zero latencies, want a growing limit", got)
+	}
+
+	before := l.Limit()
+	for i := 0; i < 5; i++ {
+		l.Update(0, 10, true)
+	}
+	if got := l.Limit(); got >= before {
+		t.Fatalf("limit = %d after drops, want below %d", got, before)
+	}
+}
+
+func TestGradientLimitZeroWindow(t *testing.T) {
+	l := NewGradientLimit(10)
+	l.LongWindow = 0
+
+	for i := 0; i < 100; i++ {
+		got := l.Update(time.Duration(i+1)*time.Millisecond, 1000, false)
+		if got < l.MinLimit || got > l.MaxLimit {
+			t.Fatalf("Update() = %d, out of [%d, %d]", got, l.MinLimit, l.MaxLimit)
+		}
+	}
+}
+
+func waitQueued(t *testing.T, l *Limiter, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		l.Lock()
+		queued := l.waiters.Len()
+		l.Unlock()
+
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers queued, want %d", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimiterFIFO(t *testing.T) {
+	l := NewLimiter(NewFixedLimit(1), 0)
+
+	done, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			done, err := l.Acquire(context.Background())
+			if err != nil {
+				order <- -1
+				return
+			}
+			order <- i
+			done(nil)
+		}(i)
+		waitQueued(t, l, i+1)
+	}
+
+	done(nil)
+	for want := 0; want < 3; want++ {
+		if got := <-order; got != want {
+			t.Fatalf("caller %d got the slot, want caller %d", got, want)
+		}
+	}
+	if n := l.Inflight(); n != 0 {
+		t.Fatalf("%d in flight, want 0", n)
+	}
+}
+
+func TestLimiterAcquireCancelled(t *testing.T) {
+	l := NewLimiter(NewFixedLimit(1), 0)
+
+	done, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(ctx)
+		acquired <- err
+	}()
+	waitQueued(t, l, 1)
+
+	cancel()
+	if err = <-acquired; err != context.Canceled {
+		t.Fatalf("Acquire() error = %v, want %v", err, context.Canceled)
+	}
+	waitQueued(t, l, 0)
+
+	// the cancelled caller doesn't hold a slot
+	done(nil)
+	if n := l.Inflight(); n != 0 {
+		t.Fatalf("%d in flight, want 0", n)
+	}
+	if _, err = l.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAIMDLimit(t *testing.T) {
+	l := NewAIMDLimit(10)
+	l.Timeout = time.Second
+
+	steps := []struct {
+		rtt      time.Duration
+		inflight int
+		dropped  bool
+		want     int
+	}{
+		// grows while at least half the limit is used
+		{10 * time.Millisecond, 5, false, 11},
+		{10 * time.Millisecond, 6, false, 12},
+		{10 * time.Millisecond, 1, false, 12},
+		// shrinks on drops and on latencies above the timeout
+		{10 * time.Millisecond, 12, true, 10},
+		{2 * time.Second, 10, false, 9},
+	}
+
+	for i, s := range steps {
+		if got := l.Update(s.rtt, s.inflight, s.dropped); got != s.want {
+			t.Fatalf("step %d: Update() = %d, want %d", i, got, s.want)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		l.Update(0, 0, true)
+	}
+	if got := l.Limit(); got != l.MinLimit {
+		t.Fatalf("limit = %d after many drops, want the minimum %d", got, l.MinLimit)
+	}
+
+	l.MaxLimit = 2
+	for i := 0; i < 5; i++ {
+		l.Update(time.Millisecond, 2, false)
+	}
+	if got := l.Limit(); got != 2 {
+		t.Fatalf("limit = %d, want the maximum 2", got)
+	}
+}
+
+func TestLimiterAIMD(t *testing.T) {
+	l := NewLimiter(NewAIMDLimit(4), 0)
+
+	release := func(err error) {
+		t.Helper()
+
+		done, aerr := l.Acquire(context.Background())
+		if aerr != nil {
+			t.Fatal(aerr)
+		}
+		done(err)
+	}
+
+	// a single call uses too little of the limit to grow it
+	release(nil)
+	if got := l.Limit(); got != 4 {
+		t.Fatalf("limit = %d, want 4", got)
+	}
+
+	release(ErrTimeout)
+	if got := l.Limit(); got != 3 {
+		t.Fatalf("limit = %d after a timeout, want 3", got)
+	}
+
+	// other failures say nothing about the load
+	release(errors.New("refused"))
+	if got := l.Limit(); got != 3 {
+		t.Fatalf("limit = %d after a failure, want 3", got)
+	}
+
+	var dones []func(error)
+	for i := 0; i < 2; i++ {
+		done, err := l.Acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dones = append(dones, done)
+	}
+	dones[1](nil)
+	if got := l.Limit(); got != 4 {
+		t.Fatalf("limit = %d after a call with the limit in use, want 4", got)
+	}
+	dones[0](nil)
+}
@@ -1,19 +1,117 @@
 package knet
 
-import "log"
+import (
+	"fmt"
+	"log"
+	"strings"
+)
 
+// Level is the severity of a log record, with the values of log/slog.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l < LevelInfo:
+		return "DEBUG"
+	case l < LevelWarn:
+		return "INFO"
+	case l < LevelError:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// Logger is a leveled logger, keyvals are alternating keys and values.
+//
+// Its methods are those of log/slog.Logger, so a *slog.Logger can be
+// passed to SetLogger as is.
 type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// PrintfLogger is the former Logger interface, adapted by NewPrintfLogger.
+type PrintfLogger interface {
 	Printf(fmt string, args ...interface{})
 }
 
+type printfLogger struct {
+	l     PrintfLogger
+	level Level
+}
+
+// NewPrintfLogger adapts l to Logger, records below level are discarded.
+// Records are formatted as "LEVEL msg: key=value, key=value".
+func NewPrintfLogger(l PrintfLogger, level Level) Logger {
+	return &printfLogger{l: l, level: level}
+}
+
+func (l *printfLogger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+func (l *printfLogger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+func (l *printfLogger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+func (l *printfLogger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+func (l *printfLogger) log(level Level, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString(", ")
+		}
+
+		// same as slog for a value without a key
+		if i+1 == len(keyvals) {
+			fmt.Fprintf(&b, "!BADKEY=%v", keyvals[i])
+			break
+		}
+		fmt.Fprintf(&b, "%v=%v", keyvals[i], keyvals[i+1])
+	}
+	l.l.Printf("%s", b.String())
+}
+
 type stdLogger struct{}
 
 func (l *stdLogger) Printf(fmt string, args ...interface{}) {
 	log.Printf(fmt, args...)
 }
 
-var defaultLogger Logger = &stdLogger{}
+var defaultLogger Logger = NewPrintfLogger(&stdLogger{}, LevelInfo)
 
 func SetLogger(logger Logger) {
 	defaultLogger = logger
 }
+
+// sessionFields returns the fields identifying s in log records.
+func sessionFields(s *IoSession, keyvals ...interface{}) []interface{} {
+	return append([]interface{}{"session_id", s.id, "remote_addr", s.RemoteAddr()}, keyvals...)
+}
@@ -0,0 +1,191 @@
+package knet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultMemDialTimeout bounds MemDial when the listener doesn't accept.
+const DefaultMemDialTimeout = 5 * time.Second
+
+var (
+	ErrMemAddrInUse   = errors.New("mem address already in use")
+	ErrMemConnRefused = errors.New("mem connection refused")
+)
+
+var (
+	memListenersLock sync.Mutex
+	memListeners     = make(map[string]*memListener)
+)
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// MemListen registers an in-memory listener under the name addr. It is a
+// ListenFunc, so services can be wired together inside one process without
+// touching the network stack.
+func MemListen(addr string) (net.Listener, error) {
+	memListenersLock.Lock()
+	defer memListenersLock.Unlock()
+
+	if _, exists := memListeners[addr]; exists {
+		return nil, ErrMemAddrInUse
+	}
+
+	l := &memListener{
+		addr:   memAddr(addr),
+		connCh: make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+	memListeners[addr] = l
+	return l, nil
+}
+
+// MemDial connects to the in-memory listener registered under addr, giving
+// up after DefaultMemDialTimeout if the connection isn't accepted.
+func MemDial(addr string) (net.Conn, error) {
+	return MemDialFunc(DefaultMemDialTimeout)(addr)
+}
+
+// MemDialFunc returns a DialFunc for in-memory listeners, timeout 0 waits
+// until the connection is accepted.
+func MemDialFunc(timeout time.Duration) DialFunc {
+	return func(addr string) (net.Conn, error) {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return MemDialContext(ctx, addr)
+	}
+}
+
+// MemDialContext connects to the in-memory listener registered under addr,
+// until the connection is accepted or ctx is done.
+func MemDialContext(ctx context.Context, addr string) (net.Conn, error) {
+	memListenersLock.Lock()
+	l := memListeners[addr]
+	memListenersLock.Unlock()
+
+	if l == nil {
+		return nil, ErrMemConnRefused
+	}
+	return l.dial(ctx)
+}
+
+type memListener struct {
+	addr      memAddr
+	connCh    chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	nextId    uint64
+	idLock    sync.Mutex
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connCh:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		memListenersLock.Lock()
+		if memListeners[string(l.addr)] == l {
+			delete(memListeners, string(l.addr))
+		}
+		memListenersLock.Unlock()
+
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *memListener) dial(ctx context.Context) (net.Conn, error) {
+	l.idLock.Lock()
+	l.nextId++
+	clientAddr := memAddr(string(l.addr) + "#" + strconv.FormatUint(l.nextId, 10))
+	l.idLock.Unlock()
+
+	server, client := net.Pipe()
+
+	select {
+	case l.connCh <- &memConn{Conn: server, local: l.addr, remote: clientAddr}:
+	case <-l.done:
+		server.Close()
+		client.Close()
+		return nil, ErrMemConnRefused
+	case <-ctx.Done():
+		server.Close()
+		client.Close()
+		return nil, ctx.Err()
+	}
+	return &memConn{Conn: client, local: clientAddr, remote: l.addr}, nil
+}
+
+type memConn struct {
+	net.Conn
+	local  memAddr
+	remote memAddr
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+type MemServerConfig ServerConfig
+
+func NewMemServerConfig() *MemServerConfig {
+	conf := &MemServerConfig{}
+	conf.Io.SendQueueSize = 16
+	conf.Io.RecvQueueSize = 16
+	return conf
+}
+
+type MemServer struct {
+	*ServerBase
+}
+
+func NewMemServer(ctx context.Context, conf *MemServerConfig) *MemServer {
+	srv := &MemServer{
+		ServerBase: NewServerBase(ctx, MemListen, (*ServerConfig)(conf)),
+	}
+	return srv
+}
+
+type MemClientConfig ClientConfig
+
+func NewMemClientConfig() *MemClientConfig {
+	conf := &MemClientConfig{}
+	conf.Io.SendQueueSize = 16
+	conf.Io.RecvQueueSize = 16
+	return conf
+}
+
+type MemClient struct {
+	*ClientBase
+}
+
+func NewMemClient(ctx context.Context, conf *MemClientConfig) *MemClient {
+	c := &MemClient{
+		ClientBase: NewClientBase(ctx, MemDial, (*ClientConfig)(conf)),
+	}
+	return c
+}
@@ -0,0 +1,100 @@
+package knet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemCall(t *testing.T) {
+	startMemServer(t, "mem-call", &echoHandler{}, nil)
+	c := dialMemClient(t, "mem-call")
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+
+			body := fmt.Sprint("req ", id)
+			resp, err := c.CallWithTimeout(context.Background(), &testMsg{id: id, body: body}, time.Second)
+			if err != nil {
+				t.Errorf("call %d: %v", id, err)
+				return
+			}
+			if got := resp.(*testMsg); got.id != id || got.body != body {
+				t.Errorf("call %d: got response %d %q", id, got.id, got.body)
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+}
+
+func TestMemSessionAddrs(t *testing.T) {
+	h := newRecordHandler()
+	remote := make(chan string, 1)
+	h.onMessage = func(s *IoSession, m Message) error {
+		remote <- s.RemoteAddr().String()
+		return nil
+	}
+	startMemServer(t, "mem-addrs", h, nil)
+
+	c := dialMemClient(t, "mem-addrs")
+	if got := c.GetSession().RemoteAddr().String(); got != "mem-addrs" {
+		t.Fatalf("client remote addr = %q", got)
+	}
+
+	c.Send(context.Background(), &testMsg{id: 1})
+	if got, want := <-remote, c.GetSession().LocalAddr().String(); got != want {
+		t.Fatalf("server sees %q, client is %q", got, want)
+	}
+}
+
+func TestMemListenInUse(t *testing.T) {
+	ln, err := MemListen("mem-in-use")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if _, err = MemListen("mem-in-use"); !errors.Is(err, ErrMemAddrInUse) {
+		t.Fatalf("MemListen() error = %v, want %v", err, ErrMemAddrInUse)
+	}
+}
+
+func TestMemDialRefused(t *testing.T) {
+	if _, err := MemDial("mem-nobody"); !errors.Is(err, ErrMemConnRefused) {
+		t.Fatalf("MemDial() error = %v, want %v", err, ErrMemConnRefused)
+	}
+
+	ln, err := MemListen("mem-closed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	if _, err = MemDial("mem-closed"); !errors.Is(err, ErrMemConnRefused) {
+		t.Fatalf("MemDial() after Close error = %v, want %v", err, ErrMemConnRefused)
+	}
+}
+
+func TestMemDialNotAccepted(t *testing.T) {
+	ln, err := MemListen("mem-no-accept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if _, err = MemDialFunc(20 * time.Millisecond)("mem-no-accept"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("MemDialFunc() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = MemDialContext(ctx, "mem-no-accept"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("MemDialContext() error = %v, want %v", err, context.Canceled)
+	}
+}
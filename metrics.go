@@ -0,0 +1,378 @@
+package knet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives the events of the sessions of a service. Byte, message
+// and error counts are not reported one by one, they can be read from the
+// sessions with IoSession.Stats.
+type Metrics interface {
+	SessionOpened(session *IoSession)
+	// SessionClosed is called before OnDisconnected, session.CloseReason
+	// tells why it was closed.
+	SessionClosed(session *IoSession)
+	// ConnRejected is called for connections refused before a session was
+	// opened, reason is "overload", "rate_limit" or "access_denied".
+	ConnRejected(reason string)
+	// MessageHandled is called after OnMessage, with the time the message
+	// waited in the receive queue and the time OnMessage took.
+	MessageHandled(session *IoSession, queued, elapsed time.Duration)
+	// CallDone is called when a client call to addr completes.
+	CallDone(addr string, elapsed time.Duration, err error)
+}
+
+// metricsProvider is implemented by the services reporting metrics.
+type metricsProvider interface {
+	metrics() Metrics
+}
+
+// DefaultLatencyBuckets are the upper bounds of the latency histograms, in
+// seconds.
+var DefaultLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	sync.Mutex
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	h.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+	h.Unlock()
+}
+
+func (h *histogram) snapshot() (counts []uint64, count uint64, sum float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	// cumulative counts, as exposed by prometheus
+	counts = make([]uint64, len(h.counts))
+	var acc uint64
+	for i, c := range h.counts {
+		acc += c
+		counts[i] = acc
+	}
+	return counts, h.count, h.sum
+}
+
+// callStats are the calls of a client to one address.
+type callStats struct {
+	// 64-bit atomic fields first, for alignment on 32-bit platforms
+	ok       uint64
+	timeouts uint64
+	errors   uint64
+	latency  *histogram
+}
+
+// PrometheusMetrics collects the metrics of one service, exposed in the
+// Prometheus text format by PrometheusHandler.
+type PrometheusMetrics struct {
+	// 64-bit atomic fields first, for alignment on 32-bit platforms
+	opened uint64
+
+	// counters of the closed sessions, the open ones are read live
+	closedStats SessionStats
+
+	name     string
+	lock     sync.Mutex
+	sessions map[*IoSession]struct{}
+	rejected map[string]uint64
+	closed   map[CloseCause]uint64
+	calls    map[string]*callStats
+
+	queueLatency   *histogram
+	handlerLatency *histogram
+}
+
+// NewPrometheusMetrics creates the metrics of a service, name is exposed
+// as the "service" label. Client calls are labeled with the remote address
+// as "addr".
+func NewPrometheusMetrics(name string) *PrometheusMetrics {
+	return &PrometheusMetrics{
+		name:           name,
+		sessions:       make(map[*IoSession]struct{}),
+		rejected:       make(map[string]uint64),
+		closed:         make(map[CloseCause]uint64),
+		calls:          make(map[string]*callStats),
+		queueLatency:   newHistogram(DefaultLatencyBuckets),
+		handlerLatency: newHistogram(DefaultLatencyBuckets),
+	}
+}
+
+func (m *PrometheusMetrics) SessionOpened(session *IoSession) {
+	atomic.AddUint64(&m.opened, 1)
+
+	m.lock.Lock()
+	m.sessions[session] = struct{}{}
+	m.lock.Unlock()
+}
+
+func (m *PrometheusMetrics) SessionClosed(session *IoSession) {
+	var (
+		stats = session.Stats()
+		cause = session.CloseReason().Cause
+	)
+
+	m.lock.Lock()
+	m.closed[cause]++
+	delete(m.sessions, session)
+	addSessionStats(&m.closedStats, &stats)
+	m.lock.Unlock()
+}
+
+func (m *PrometheusMetrics) ConnRejected(reason string) {
+	m.lock.Lock()
+	m.rejected[reason]++
+	m.lock.Unlock()
+}
+
+func (m *PrometheusMetrics) MessageHandled(session *IoSession, queued, elapsed time.Duration) {
+	m.queueLatency.observe(queued)
+	m.handlerLatency.observe(elapsed)
+}
+
+func (m *PrometheusMetrics) CallDone(addr string, elapsed time.Duration, err error) {
+	m.lock.Lock()
+	calls, ok := m.calls[addr]
+	if !ok {
+		calls = &callStats{latency: newHistogram(DefaultLatencyBuckets)}
+		m.calls[addr] = calls
+	}
+	m.lock.Unlock()
+
+	calls.latency.observe(elapsed)
+
+	switch {
+	case err == nil:
+		atomic.AddUint64(&calls.ok, 1)
+	case errors.Is(err, ErrTimeout):
+		atomic.AddUint64(&calls.timeouts, 1)
+	default:
+		atomic.AddUint64(&calls.errors, 1)
+	}
+}
+
+// callAddrs returns the addresses called, sorted, with their stats.
+func (m *PrometheusMetrics) callAddrs() (addrs []string, calls []*callStats) {
+	m.lock.Lock()
+	for addr := range m.calls {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		calls = append(calls, m.calls[addr])
+	}
+	m.lock.Unlock()
+	return
+}
+
+func addSessionStats(total, stats *SessionStats) {
+	total.BytesIn += stats.BytesIn
+	total.BytesOut += stats.BytesOut
+	total.MessagesIn += stats.MessagesIn
+	total.MessagesOut += stats.MessagesOut
+	total.EncodeErrors += stats.EncodeErrors
+	total.DecodeErrors += stats.DecodeErrors
+	total.SendQueueLen += stats.SendQueueLen
+	total.RecvQueueLen += stats.RecvQueueLen
+}
+
+// totals returns the counters of all sessions, the queue lengths of the
+// open ones, the number of open sessions, and the rejected and closed
+// counts.
+func (m *PrometheusMetrics) totals() (total SessionStats, active int, rejected map[string]uint64, closed map[CloseCause]uint64) {
+	m.lock.Lock()
+	total = m.closedStats
+	sessions := make([]*IoSession, 0, len(m.sessions))
+	for s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	rejected = make(map[string]uint64, len(m.rejected))
+	for reason, n := range m.rejected {
+		rejected[reason] = n
+	}
+	closed = make(map[CloseCause]uint64, len(m.closed))
+	for cause, n := range m.closed {
+		closed[cause] = n
+	}
+	m.lock.Unlock()
+
+	total.SendQueueLen, total.RecvQueueLen = 0, 0
+	for _, s := range sessions {
+		stats := s.Stats()
+		addSessionStats(&total, &stats)
+	}
+	return total, len(sessions), rejected, closed
+}
+
+type promSample struct {
+	suffix string
+	labels string
+	value  string
+}
+
+type promFamily struct {
+	name, help, typ string
+	samples         []promSample
+}
+
+func (m *PrometheusMetrics) families() []*promFamily {
+	var (
+		total, active, rejected, closed = m.totals()
+		svc                             = `service="` + escapeLabel(m.name) + `"`
+	)
+
+	counter := func(name, help string, v uint64) *promFamily {
+		return &promFamily{name, help, "counter", []promSample{{"", svc, strconv.FormatUint(v, 10)}}}
+	}
+	gauge := func(name, help string, v int) *promFamily {
+		return &promFamily{name, help, "gauge", []promSample{{"", svc, strconv.Itoa(v)}}}
+	}
+
+	reasons := make([]string, 0, len(rejected))
+	for reason := range rejected {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	rejectedFamily := &promFamily{name: "knet_connections_rejected_total", help: "Connections refused before opening a session.", typ: "counter"}
+	for _, reason := range reasons {
+		rejectedFamily.samples = append(rejectedFamily.samples,
+			promSample{"", svc + `,reason="` + escapeLabel(reason) + `"`, strconv.FormatUint(rejected[reason], 10)})
+	}
+
+	causes := make([]CloseCause, 0, len(closed))
+	for cause := range closed {
+		causes = append(causes, cause)
+	}
+	sort.Slice(causes, func(i, j int) bool { return causes[i] < causes[j] })
+
+	closedFamily := &promFamily{name: "knet_sessions_closed_total", help: "Sessions closed, by close cause.", typ: "counter"}
+	for _, cause := range causes {
+		closedFamily.samples = append(closedFamily.samples,
+			promSample{"", svc + `,cause="` + cause.String() + `"`, strconv.FormatUint(closed[cause], 10)})
+	}
+
+	callsFamily := &promFamily{name: "knet_calls_total", help: "Client calls by address and result.", typ: "counter"}
+	callLatencyFamily := &promFamily{name: "knet_call_duration_seconds", help: "Client call latency.", typ: "histogram"}
+	addrs, calls := m.callAddrs()
+	for i, addr := range addrs {
+		labels := svc + `,addr="` + escapeLabel(addr) + `"`
+		callsFamily.samples = append(callsFamily.samples,
+			promSample{"", labels + `,result="ok"`, strconv.FormatUint(atomic.LoadUint64(&calls[i].ok), 10)},
+			promSample{"", labels + `,result="timeout"`, strconv.FormatUint(atomic.LoadUint64(&calls[i].timeouts), 10)},
+			promSample{"", labels + `,result="error"`, strconv.FormatUint(atomic.LoadUint64(&calls[i].errors), 10)},
+		)
+		callLatencyFamily.samples = append(callLatencyFamily.samples, histogramSamples(labels, calls[i].latency)...)
+	}
+
+	return []*promFamily{
+		counter("knet_sessions_opened_total", "Sessions opened.", atomic.LoadUint64(&m.opened)),
+		closedFamily,
+		gauge("knet_sessions_active", "Sessions currently open.", active),
+		rejectedFamily,
+		counter("knet_read_bytes_total", "Bytes read.", total.BytesIn),
+		counter("knet_written_bytes_total", "Bytes written.", total.BytesOut),
+		counter("knet_read_messages_total", "Messages read.", total.MessagesIn),
+		counter("knet_written_messages_total", "Messages written.", total.MessagesOut),
+		counter("knet_decode_errors_total", "Failed decodes, including read errors.", total.DecodeErrors),
+		counter("knet_encode_errors_total", "Failed encodes.", total.EncodeErrors),
+		gauge("knet_send_queue_length", "Messages waiting in the send queues.", total.SendQueueLen),
+		gauge("knet_recv_queue_length", "Messages waiting in the receive queues.", total.RecvQueueLen),
+		histogramFamily("knet_queue_duration_seconds", "Time messages waited in the receive queue.", svc, m.queueLatency),
+		histogramFamily("knet_handler_duration_seconds", "Time spent in OnMessage.", svc, m.handlerLatency),
+		callsFamily,
+		callLatencyFamily,
+	}
+}
+
+func histogramFamily(name, help, labels string, h *histogram) *promFamily {
+	return &promFamily{name: name, help: help, typ: "histogram", samples: histogramSamples(labels, h)}
+}
+
+func histogramSamples(labels string, h *histogram) (samples []promSample) {
+	counts, count, sum := h.snapshot()
+
+	for i, bound := range h.bounds {
+		samples = append(samples, promSample{
+			"_bucket", labels + `,le="` + formatFloat(bound) + `"`, strconv.FormatUint(counts[i], 10),
+		})
+	}
+	return append(samples,
+		promSample{"_bucket", labels + `,le="+Inf"`, strconv.FormatUint(count, 10)},
+		promSample{"_sum", labels, formatFloat(sum)},
+		promSample{"_count", labels, strconv.FormatUint(count, 10)},
+	)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// WritePrometheus writes the metrics of the services in the Prometheus
+// text format.
+func WritePrometheus(w io.Writer, metrics ...*PrometheusMetrics) error {
+	var families [][]*promFamily
+	for _, m := range metrics {
+		families = append(families, m.families())
+	}
+
+	if len(families) == 0 {
+		return nil
+	}
+
+	for i, f := range families[0] {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ); err != nil {
+			return err
+		}
+
+		for _, service := range families {
+			for _, s := range service[i].samples {
+				if _, err := fmt.Fprintf(w, "%s%s{%s} %s\n", f.name, s.suffix, s.labels, s.value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// PrometheusHandler serves the metrics of the services in the Prometheus
+// text format.
+func PrometheusHandler(metrics ...*PrometheusMetrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = WritePrometheus(w, metrics...)
+	})
+}
@@ -0,0 +1,44 @@
+package knet
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallMetricsByAddr(t *testing.T) {
+	startMemServer(t, "metrics-a", &echoHandler{}, nil)
+	startMemServer(t, "metrics-b", &echoHandler{}, nil)
+
+	m := NewPrometheusMetrics("backend")
+	for _, addr := range []string{"metrics-a", "metrics-b", "metrics-b"} {
+		c := NewMemClient(testContext(t), NewMemClientConfig())
+		c.SetProtocol(testProto{})
+		c.SetMetrics(m)
+		if err := c.Dial(addr); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if _, err := c.CallWithTimeout(context.Background(), &testMsg{id: 1}, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`knet_calls_total{service="backend",addr="metrics-a",result="ok"} 1`,
+		`knet_calls_total{service="backend",addr="metrics-b",result="ok"} 2`,
+		`knet_call_duration_seconds_count{service="backend",addr="metrics-b"} 2`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("metrics miss %s", want)
+		}
+	}
+}
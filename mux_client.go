@@ -0,0 +1,343 @@
+package knet
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type MuxClientConfig struct {
+	// MinConns connections are kept open to the endpoint.
+	MinConns int
+	// MaxConns caps the connections to the endpoint.
+	MaxConns int
+	// GrowThreshold is the in-flight call count per connection above which
+	// a new connection is opened.
+	GrowThreshold int
+}
+
+func NewMuxClientConfig() *MuxClientConfig {
+	return &MuxClientConfig{
+		MinConns:      1,
+		MaxConns:      8,
+		GrowThreshold: 32,
+	}
+}
+
+type muxConn struct {
+	Client
+	inflight int64
+}
+
+// MuxClient shares a few long-lived connections to one endpoint among all
+// concurrent callers, routing each call to the least loaded connection.
+// There is no borrowing, the client is used directly by every goroutine.
+type MuxClient struct {
+	sync.RWMutex
+	conf     *MuxClientConfig
+	factory  EndpointFactory
+	addr     string
+	conns    []*muxConn
+	growing  int32
+	protocol Protocol
+	handler  IoHandler
+	closed   bool
+
+	// growLock serializes the connections opened to restore MinConns or a
+	// live connection, so that callers finding every connection dead don't
+	// each dial their own
+	growLock sync.Mutex
+}
+
+func NewMuxClient(factory EndpointFactory, conf *MuxClientConfig) *MuxClient {
+	if conf.MinConns <= 0 {
+		conf.MinConns = 1
+	}
+	if conf.MaxConns < conf.MinConns {
+		conf.MaxConns = conf.MinConns
+	}
+
+	return &MuxClient{
+		conf:    conf,
+		factory: factory,
+	}
+}
+
+// MuxEndpointFactory returns an EndpointFactory creating a MuxClient per
+// endpoint, for use with BalancedClient.
+func MuxEndpointFactory(factory EndpointFactory, conf *MuxClientConfig) EndpointFactory {
+	return EndpointFactoryFunc(func(addr string) (Client, error) {
+		muxConf := *conf
+		return NewMuxClient(factory, &muxConf), nil
+	})
+}
+
+func (c *MuxClient) Dial(addr string) (err error) {
+	c.Lock()
+	c.addr = addr
+	c.Unlock()
+
+	return c.fill(false)
+}
+
+func (c *MuxClient) Close() {
+	c.Lock()
+	c.closed = true
+	conns := c.conns
+	c.conns = nil
+	c.Unlock()
+
+	for _, mc := range conns {
+		mc.Close()
+	}
+}
+
+func (c *MuxClient) Disconnect() {
+	for _, mc := range c.list() {
+		mc.Disconnect()
+	}
+}
+
+func (c *MuxClient) SetProtocol(p Protocol) {
+	c.Lock()
+	c.protocol = p
+	c.Unlock()
+
+	for _, mc := range c.list() {
+		mc.SetProtocol(p)
+	}
+}
+
+func (c *MuxClient) SetIoHandler(h IoHandler) {
+	c.Lock()
+	c.handler = h
+	c.Unlock()
+
+	for _, mc := range c.list() {
+		mc.SetIoHandler(h)
+	}
+}
+
+func (c *MuxClient) Call(ctx context.Context, req Request) (Response, error) {
+	return c.CallWithTimeout(ctx, req, 0)
+}
+
+func (c *MuxClient) CallWithTimeout(ctx context.Context, req Request, timeout time.Duration) (resp Response, err error) {
+	var mc *muxConn
+	if mc, err = c.pick(); err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&mc.inflight, 1)
+	resp, err = mc.CallWithTimeout(ctx, req, timeout)
+	atomic.AddInt64(&mc.inflight, -1)
+	return
+}
+
+func (c *MuxClient) Send(ctx context.Context, msg Message) error {
+	return c.SendWithTimeout(ctx, msg, 0)
+}
+
+func (c *MuxClient) SendWithTimeout(ctx context.Context, msg Message, timeout time.Duration) (err error) {
+	var mc *muxConn
+	if mc, err = c.pick(); err != nil {
+		return err
+	}
+	return mc.SendWithTimeout(ctx, msg, timeout)
+}
+
+// GetSession returns nil, a mux client has one session per connection.
+func (c *MuxClient) GetSession() *IoSession {
+	return nil
+}
+
+func (c *MuxClient) IsClosed() (closed bool) {
+	c.RLock()
+	closed = c.closed
+	c.RUnlock()
+	return
+}
+
+func (c *MuxClient) IsConnected() bool {
+	for _, mc := range c.list() {
+		if mc.IsConnected() {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingCount returns the number of in-flight calls over all connections.
+func (c *MuxClient) PendingCount() (n int) {
+	for _, mc := range c.list() {
+		n += int(atomic.LoadInt64(&mc.inflight))
+	}
+	return
+}
+
+// NumConns returns the number of open connections.
+func (c *MuxClient) NumConns() int {
+	return len(c.list())
+}
+
+func (c *MuxClient) list() (conns []*muxConn) {
+	c.RLock()
+	conns = c.conns
+	c.RUnlock()
+	return
+}
+
+func (c *MuxClient) pick() (picked *muxConn, err error) {
+	if c.IsClosed() {
+		return nil, ErrClientClosed
+	}
+
+	var (
+		min  int64
+		dead bool
+	)
+
+	for retry := false; picked == nil; retry = true {
+		for _, mc := range c.list() {
+			if !mc.IsConnected() {
+				dead = true
+				continue
+			}
+			if n := atomic.LoadInt64(&mc.inflight); picked == nil || n < min {
+				picked, min = mc, n
+			}
+		}
+
+		if dead {
+			c.prune()
+		}
+
+		if picked != nil {
+			break
+		}
+
+		if retry {
+			return nil, ErrClientDisconnected
+		}
+
+		// every connection is gone, reconnect synchronously
+		if err = c.reconnect(); err != nil {
+			return
+		}
+	}
+
+	if (min >= int64(c.conf.GrowThreshold) || dead) && atomic.CompareAndSwapInt32(&c.growing, 0, 1) {
+		more := min >= int64(c.conf.GrowThreshold)
+		go func() {
+			defer atomic.StoreInt32(&c.growing, 0)
+			if err := c.fill(more); err != nil && err != ErrClientPoolExhausted && err != ErrClientClosed {
+				defaultLogger.Warn("grow mux connections failed", "addr", c.addr, "error", err)
+			}
+		}()
+	}
+	return
+}
+
+// reconnect opens a connection unless another caller restored one while
+// this one waited.
+func (c *MuxClient) reconnect() error {
+	c.growLock.Lock()
+	defer c.growLock.Unlock()
+
+	for _, mc := range c.list() {
+		if mc.IsConnected() {
+			return nil
+		}
+	}
+	return c.grow()
+}
+
+// fill opens connections up to MinConns, and one more if more is set.
+func (c *MuxClient) fill(more bool) (err error) {
+	c.growLock.Lock()
+	defer c.growLock.Unlock()
+
+	for more || c.NumConns() < c.conf.MinConns {
+		if err = c.grow(); err != nil {
+			return
+		}
+		more = false
+	}
+	return
+}
+
+// grow opens one more connection unless MaxConns is reached.
+func (c *MuxClient) grow() (err error) {
+	c.RLock()
+	var (
+		addr     = c.addr
+		full     = len(c.conns) >= c.conf.MaxConns
+		p, h     = c.protocol, c.handler
+		isClosed = c.closed
+	)
+	c.RUnlock()
+
+	switch {
+	case isClosed:
+		return ErrClientClosed
+	case full:
+		return ErrClientPoolExhausted
+	}
+
+	var client Client
+	if client, err = c.factory.NewClient(addr); err != nil {
+		return
+	}
+
+	if p != nil {
+		client.SetProtocol(p)
+	}
+	if h != nil {
+		client.SetIoHandler(h)
+	}
+
+	if err = client.Dial(addr); err != nil {
+		client.Close()
+		return
+	}
+
+	c.Lock()
+	if isClosed, full = c.closed, len(c.conns) >= c.conf.MaxConns; isClosed || full {
+		c.Unlock()
+		client.Close()
+		if isClosed {
+			return ErrClientClosed
+		}
+		return ErrClientPoolExhausted
+	}
+	conns := make([]*muxConn, len(c.conns), len(c.conns)+1)
+	copy(conns, c.conns)
+	c.conns = append(conns, &muxConn{Client: client})
+	n := len(c.conns)
+	c.Unlock()
+
+	defaultLogger.Info("mux connection added", "addr", addr, "conns", n)
+	return
+}
+
+// prune closes and drops the connections which lost their session.
+func (c *MuxClient) prune() {
+	var dead []*muxConn
+
+	c.Lock()
+	conns := make([]*muxConn, 0, len(c.conns))
+	for _, mc := range c.conns {
+		if mc.IsConnected() {
+			conns = append(conns, mc)
+		} else {
+			dead = append(dead, mc)
+		}
+	}
+	c.conns = conns
+	c.Unlock()
+
+	for _, mc := range dead {
+		mc.Close()
+	}
+}
@@ -0,0 +1,237 @@
+package knet
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// holdHandler replies to the messages once released, recording the
+// session each message came on.
+type holdHandler struct {
+	IoHandlerAdapter
+	release chan struct{}
+
+	lock     sync.Mutex
+	sessions map[uint64]*IoSession
+}
+
+func newHoldHandler() *holdHandler {
+	return &holdHandler{release: make(chan struct{}), sessions: make(map[uint64]*IoSession)}
+}
+
+func (h *holdHandler) OnMessage(s *IoSession, m Message) error {
+	h.lock.Lock()
+	h.sessions[m.(*testMsg).id] = s
+	h.lock.Unlock()
+
+	go func() {
+		<-h.release
+		msg := *m.(*testMsg)
+		s.Send(s.MessageContext(), &msg)
+	}()
+	return nil
+}
+
+func (h *holdHandler) session(id uint64) *IoSession {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.sessions[id]
+}
+
+// waitHeld waits for the handler to hold the message id.
+func (h *holdHandler) waitHeld(t *testing.T, id uint64) *IoSession {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for h.session(id) == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("message %d not received", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return h.session(id)
+}
+
+// memEndpointFactory creates MemClients, counting them in dials.
+func memEndpointFactory(t *testing.T, dials *int32) EndpointFactory {
+	return EndpointFactoryFunc(func(addr string) (Client, error) {
+		atomic.AddInt32(dials, 1)
+		return NewMemClient(testContext(t), NewMemClientConfig()), nil
+	})
+}
+
+func dialMuxClient(t *testing.T, addr string, dials *int32, conf *MuxClientConfig) *MuxClient {
+	t.Helper()
+
+	c := NewMuxClient(memEndpointFactory(t, dials), conf)
+	c.SetProtocol(testProto{})
+	if err := c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func waitConns(t *testing.T, c *MuxClient, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		live := 0
+		for _, mc := range c.list() {
+			if mc.IsConnected() {
+				live++
+			}
+		}
+		if live == want && c.NumConns() == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections, %d live, want %d", c.NumConns(), live, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// callAsync starts a call, the returned channel gets its error.
+func callAsync(c Client, id uint64) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Call(context.Background(), &testMsg{id: id})
+		done <- err
+	}()
+	return done
+}
+
+func TestMuxClientLeastLoaded(t *testing.T) {
+	h := newHoldHandler()
+	startMemServer(t, "mux-route", h, nil)
+
+	var dials int32
+	conf := NewMuxClientConfig()
+	conf.MinConns = 2
+	c := dialMuxClient(t, "mux-route", &dials, conf)
+
+	first := callAsync(c, 1)
+	s1 := h.waitHeld(t, 1)
+	second := callAsync(c, 2)
+	s2 := h.waitHeld(t, 2)
+
+	if s1 == s2 {
+		t.Fatal("second call sent on the busy connection")
+	}
+
+	close(h.release)
+	for _, done := range []<-chan error{first, second} {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMuxClientGrow(t *testing.T) {
+	h := newHoldHandler()
+	startMemServer(t, "mux-grow", h, nil)
+
+	var dials int32
+	conf := NewMuxClientConfig()
+	conf.MaxConns = 2
+	conf.GrowThreshold = 1
+	c := dialMuxClient(t, "mux-grow", &dials, conf)
+
+	var calls []<-chan error
+	for i := uint64(1); i <= 5; i++ {
+		calls = append(calls, callAsync(c, i))
+		h.waitHeld(t, i)
+	}
+
+	// loaded past the threshold, it grows up to MaxConns only
+	waitConns(t, c, 2)
+	time.Sleep(20 * time.Millisecond)
+	if n := c.NumConns(); n != 2 {
+		t.Fatalf("%d connections, want at most 2", n)
+	}
+
+	close(h.release)
+	for _, done := range calls {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMuxClientPruneRefills(t *testing.T) {
+	startMemServer(t, "mux-prune", &echoHandler{}, nil)
+
+	var dials int32
+	conf := NewMuxClientConfig()
+	conf.MinConns = 3
+	c := dialMuxClient(t, "mux-prune", &dials, conf)
+
+	for _, mc := range c.list()[:2] {
+		mc.GetSession().Close()
+		for mc.IsConnected() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if _, err := c.Call(context.Background(), &testMsg{id: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the dead connections are dropped and replaced to keep MinConns
+	waitConns(t, c, 3)
+	if n := atomic.LoadInt32(&dials); n != 5 {
+		t.Fatalf("%d dials, want 5", n)
+	}
+}
+
+func TestMuxClientReconnectOnce(t *testing.T) {
+	startMemServer(t, "mux-herd", &echoHandler{}, nil)
+
+	var dials int32
+	c := dialMuxClient(t, "mux-herd", &dials, NewMuxClientConfig())
+
+	mc := c.list()[0]
+	mc.GetSession().Close()
+	for mc.IsConnected() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// every caller finds the connection dead, one reconnects for all
+	var calls []<-chan error
+	for i := uint64(1); i <= 20; i++ {
+		calls = append(calls, callAsync(c, i))
+	}
+	for _, done := range calls {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Fatalf("%d dials, want 2", n)
+	}
+}
+
+func TestMuxClientClosedWhileDialing(t *testing.T) {
+	startMemServer(t, "mux-closed", &echoHandler{}, nil)
+
+	var c *MuxClient
+	factory := EndpointFactoryFunc(func(addr string) (Client, error) {
+		c.Close()
+		return NewMemClient(testContext(t), NewMemClientConfig()), nil
+	})
+
+	c = NewMuxClient(factory, NewMuxClientConfig())
+	c.SetProtocol(testProto{})
+	if err := c.Dial("mux-closed"); err != ErrClientClosed {
+		t.Fatalf("Dial() error = %v when closed while dialing, want %v", err, ErrClientClosed)
+	}
+	if n := c.NumConns(); n != 0 {
+		t.Fatalf("%d connections after Close", n)
+	}
+}
@@ -0,0 +1,106 @@
+package knet
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// OverloadHandler answers the messages shed while the server is
+// overloaded, typically with a "server busy" response so that the client
+// fails fast and retries elsewhere. Returning an error closes the session.
+type OverloadHandler interface {
+	OnOverload(session *IoSession, msg Message) error
+}
+
+type OverloadHandlerFunc func(session *IoSession, msg Message) error
+
+func (f OverloadHandlerFunc) OnOverload(session *IoSession, msg Message) error {
+	return f(session, msg)
+}
+
+type OverloadConfig struct {
+	// MaxInFlight caps the messages read but not handled yet, across all
+	// sessions. 0 means no limit.
+	MaxInFlight int
+	// MaxQueueLatency caps the average time messages wait in the receive
+	// queues before being handled. 0 means no limit.
+	MaxQueueLatency time.Duration
+	// RejectConnections closes the new connections while overloaded.
+	RejectConnections bool
+	// Handler answers the shed messages, they are dropped if nil.
+	Handler OverloadHandler
+}
+
+// loadShedder is implemented by the services tracking the messages of
+// their sessions. admit is called for every message read and returns false
+// if the message was shed, done is called once an admitted message was
+// handled, with the time it waited in the receive queue. release is called
+// instead for an admitted message dropped by a closing session, its wait
+// says nothing about the load.
+type loadShedder interface {
+	admit(session *IoSession, msg Message) (admitted bool, err error)
+	done(queueLatency time.Duration)
+	release()
+}
+
+// shedderProvider is implemented by the services able to shed load,
+// shedder returns nil when load shedding is disabled.
+type shedderProvider interface {
+	shedder() loadShedder
+}
+
+// queueLatencyWeight weighs every sample into the average queue latency.
+const queueLatencyWeight = 0.1
+
+type loadTracker struct {
+	inflight     int64
+	shed         uint64
+	queueLatency int64
+	overload     *OverloadConfig
+}
+
+func (t *loadTracker) overloaded() bool {
+	if t.overload == nil {
+		return false
+	}
+
+	inflight := atomic.LoadInt64(&t.inflight)
+
+	if t.overload.MaxInFlight > 0 && inflight >= int64(t.overload.MaxInFlight) {
+		return true
+	}
+
+	// the average only moves with the traffic, ignore it once drained
+	return t.overload.MaxQueueLatency > 0 && inflight > 0 &&
+		time.Duration(atomic.LoadInt64(&t.queueLatency)) > t.overload.MaxQueueLatency
+}
+
+func (t *loadTracker) admit(session *IoSession, msg Message) (bool, error) {
+	if t.overloaded() {
+		atomic.AddUint64(&t.shed, 1)
+
+		if h := t.overload.Handler; h != nil {
+			return false, h.OnOverload(session, msg)
+		}
+		return false, nil
+	}
+
+	atomic.AddInt64(&t.inflight, 1)
+	return true, nil
+}
+
+func (t *loadTracker) release() {
+	atomic.AddInt64(&t.inflight, -1)
+}
+
+func (t *loadTracker) done(queueLatency time.Duration) {
+	t.release()
+
+	for {
+		avg := atomic.LoadInt64(&t.queueLatency)
+		next := avg + int64(float64(int64(queueLatency)-avg)*queueLatencyWeight)
+		if atomic.CompareAndSwapInt64(&t.queueLatency, avg, next) {
+			return
+		}
+	}
+}
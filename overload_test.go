@@ -0,0 +1,186 @@
+package knet
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitInFlight(t *testing.T, srv *MemServer, want int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for srv.Stats().InFlight != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages in flight, want %d", srv.Stats().InFlight, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNoShedderWithoutOverload(t *testing.T) {
+	h := newRecordHandler()
+	shedder := make(chan loadShedder, 1)
+	h.onMessage = func(s *IoSession, m Message) error {
+		shedder <- s.shedder
+		return nil
+	}
+	startMemServer(t, "overload-off", h, nil)
+
+	c := dialMemClient(t, "overload-off")
+	c.Send(context.Background(), &testMsg{id: 1})
+
+	if got := <-shedder; got != nil {
+		t.Fatalf("session shedder = %v without an overload config", got)
+	}
+}
+
+func TestOverloadShedsMessages(t *testing.T) {
+	var (
+		shed    int32
+		release = make(chan struct{})
+		started = make(chan struct{}, 1)
+	)
+
+	h := newRecordHandler()
+	h.onMessage = func(s *IoSession, m Message) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+
+	conf := NewMemServerConfig()
+	conf.Overload = &OverloadConfig{
+		MaxInFlight: 1,
+		Handler: OverloadHandlerFunc(func(*IoSession, Message) error {
+			atomic.AddInt32(&shed, 1)
+			return nil
+		}),
+	}
+	srv := startMemServer(t, "overload-shed", h, conf)
+
+	c := dialMemClient(t, "overload-shed")
+	c.Send(context.Background(), &testMsg{id: 1})
+	<-started
+
+	c.Send(context.Background(), &testMsg{id: 2})
+	c.Send(context.Background(), &testMsg{id: 3})
+
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadInt32(&shed) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages shed, want 2", atomic.LoadInt32(&shed))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := srv.Stats(); stats.Shed != 2 || stats.InFlight != 1 {
+		t.Fatalf("stats = %+v, want 2 shed and 1 in flight", stats)
+	}
+
+	close(release)
+	waitInFlight(t, srv, 0)
+}
+
+func TestOverloadReleasesQueuedOnClose(t *testing.T) {
+	var (
+		release = make(chan struct{})
+		started = make(chan struct{}, 1)
+	)
+
+	h := newRecordHandler()
+	h.onMessage = func(s *IoSession, m Message) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	}
+
+	conf := NewMemServerConfig()
+	conf.Overload = &OverloadConfig{MaxInFlight: 100}
+	srv := startMemServer(t, "overload-close", h, conf)
+
+	c := dialMemClient(t, "overload-close")
+	for i := uint64(1); i <= 5; i++ {
+		c.Send(context.Background(), &testMsg{id: i})
+	}
+	<-started
+	waitInFlight(t, srv, 5)
+
+	// the messages still queued when the session closes are released too
+	c.Close()
+	close(release)
+	h.waitClosed(t)
+	waitInFlight(t, srv, 0)
+}
+
+func TestLoadTrackerConcurrentDone(t *testing.T) {
+	var (
+		tracker loadTracker
+		wg      sync.WaitGroup
+	)
+
+	tracker.inflight = 100
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tracker.done(10 * time.Millisecond)
+		}()
+	}
+	wg.Wait()
+
+	if tracker.inflight != 0 {
+		t.Fatalf("%d in flight, want 0", tracker.inflight)
+	}
+	// 100 samples of 10ms from 0 leave the average within 1µs of it
+	if latency := time.Duration(tracker.queueLatency); latency < 10*time.Millisecond-time.Microsecond {
+		t.Fatalf("queue latency = %v, samples were lost", latency)
+	}
+}
+
+func TestOverloadCloseKeepsQueueLatency(t *testing.T) {
+	var (
+		release = make(chan struct{})
+		started = make(chan *IoSession, 1)
+	)
+
+	h := newRecordHandler()
+	h.onMessage = func(s *IoSession, m Message) error {
+		select {
+		case started <- s:
+		default:
+		}
+		<-release
+		return nil
+	}
+
+	conf := NewMemServerConfig()
+	conf.Io.RecvQueueSize = 1
+	conf.Overload = &OverloadConfig{MaxInFlight: 100}
+	srv := startMemServer(t, "overload-latency", h, conf)
+
+	// one message handled, one queued and one waiting for the queue
+	c := dialMemClient(t, "overload-latency")
+	for i := uint64(1); i <= 3; i++ {
+		c.Send(context.Background(), &testMsg{id: i})
+	}
+	session := <-started
+	waitInFlight(t, srv, 3)
+
+	atomic.StoreInt64(&srv.loadTracker.queueLatency, int64(time.Second))
+
+	session.Close()
+	close(release)
+	h.waitClosed(t)
+	waitInFlight(t, srv, 0)
+
+	// the handled messages are samples, at most two, the dropped one is not
+	want := time.Duration(float64(time.Second) * (1 - queueLatencyWeight) * (1 - queueLatencyWeight))
+	if latency := srv.Stats().QueueLatency; latency < want-10*time.Millisecond {
+		t.Fatalf("queue latency = %v after close, want at least %v", latency, want)
+	}
+}
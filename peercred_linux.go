@@ -0,0 +1,31 @@
+//go:build linux
+
+package knet
+
+import (
+	"net"
+	"syscall"
+)
+
+func getPeerCred(c *net.UnixConn) (cred *PeerCred, err error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var (
+		ucred *syscall.Ucred
+		cerr  error
+	)
+
+	if err = raw.Control(func(fd uintptr) {
+		ucred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return
+	}
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	return &PeerCred{Pid: ucred.Pid, Uid: ucred.Uid, Gid: ucred.Gid}, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package knet
+
+import "net"
+
+func getPeerCred(c *net.UnixConn) (*PeerCred, error) {
+	return nil, ErrPeerCredNotSupported
+}
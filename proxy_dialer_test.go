@@ -0,0 +1,230 @@
+package knet
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// standInProxy accepts one connection at a time, runs handshake on it and
+// then echoes the tunnel, acting as the target. It sends the requested
+// targets on the returned channel.
+func standInProxy(t *testing.T, handshake func(net.Conn, *bufio.Reader) (target string, ok bool)) (addr string, targets chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	targets = make(chan string, 4)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				target, ok := handshake(conn, br)
+				targets <- target
+				if ok {
+					io.Copy(conn, br)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), targets
+}
+
+func httpConnectProxy(t *testing.T, auth *ProxyAuth) (string, chan string) {
+	return standInProxy(t, func(conn net.Conn, br *bufio.Reader) (string, bool) {
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return "", false
+		}
+
+		if auth != nil {
+			want := "Basic " + base64.StdEncoding.EncodeToString([]byte(auth.Username+":"+auth.Password))
+			if req.Header.Get("Proxy-Authorization") != want {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				return req.Host, false
+			}
+		}
+
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, true
+	})
+}
+
+// socks5Proxy replies to the connect request with reply, 0 for success.
+func socks5Proxy(t *testing.T, auth *ProxyAuth, reply byte) (string, chan string) {
+	return standInProxy(t, func(conn net.Conn, br *bufio.Reader) (string, bool) {
+		var hdr [2]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return "", false
+		}
+		methods := make([]byte, hdr[1])
+		io.ReadFull(br, methods)
+
+		if auth == nil {
+			conn.Write([]byte{0x05, 0x00})
+		} else {
+			conn.Write([]byte{0x05, 0x02})
+
+			io.ReadFull(br, hdr[:])
+			user := make([]byte, hdr[1])
+			io.ReadFull(br, user)
+			io.ReadFull(br, hdr[:1])
+			pass := make([]byte, hdr[0])
+			io.ReadFull(br, pass)
+
+			if string(user) != auth.Username || string(pass) != auth.Password {
+				conn.Write([]byte{0x01, 0x01})
+				return "", false
+			}
+			conn.Write([]byte{0x01, 0x00})
+		}
+
+		var req [4]byte
+		if _, err := io.ReadFull(br, req[:]); err != nil {
+			return "", false
+		}
+
+		var host string
+		switch req[3] {
+		case 0x01:
+			ip := make([]byte, net.IPv4len)
+			io.ReadFull(br, ip)
+			host = net.IP(ip).String()
+		case 0x03:
+			io.ReadFull(br, hdr[:1])
+			name := make([]byte, hdr[0])
+			io.ReadFull(br, name)
+			host = string(name)
+		}
+		io.ReadFull(br, hdr[:])
+		target := net.JoinHostPort(host, strconv.Itoa(int(hdr[0])<<8|int(hdr[1])))
+
+		conn.Write([]byte{0x05, reply, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		return target, reply == 0
+	})
+}
+
+func checkTunnel(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("ping"))
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("tunnel echo = %q, %v", buf, err)
+	}
+}
+
+func checkTarget(t *testing.T, targets chan string, want string) {
+	t.Helper()
+
+	if got := <-targets; got != want {
+		t.Fatalf("proxy asked for %q, want %q", got, want)
+	}
+}
+
+func TestHTTPConnectDial(t *testing.T) {
+	addr, targets := httpConnectProxy(t, nil)
+
+	conn, err := HTTPConnectDialFunc(addr, nil, time.Second)("backend.example:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTarget(t, targets, "backend.example:9000")
+	checkTunnel(t, conn)
+}
+
+func TestHTTPConnectDialAuth(t *testing.T) {
+	auth := &ProxyAuth{Username: "user", Password: "secret"}
+	addr, targets := httpConnectProxy(t, auth)
+
+	conn, err := ProxyDialFunc("http://user:secret@"+addr, time.Second)("backend.example:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTarget(t, targets, "backend.example:9000")
+	checkTunnel(t, conn)
+
+	_, err = HTTPConnectDialFunc(addr, &ProxyAuth{Username: "user", Password: "wrong"}, time.Second)("backend.example:9000")
+
+	var pe *ProxyDialError
+	if !errors.As(err, &pe) || pe.Code != http.StatusProxyAuthRequired || !errors.Is(err, ErrProxyAuthFailed) {
+		t.Fatalf("dial with a wrong password: error = %v", err)
+	}
+}
+
+func TestSOCKS5Dial(t *testing.T) {
+	addr, targets := socks5Proxy(t, nil, 0)
+
+	conn, err := SOCKS5DialFunc(addr, nil, time.Second)("backend.example:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTarget(t, targets, "backend.example:9000")
+	checkTunnel(t, conn)
+
+	if conn, err = SOCKS5DialFunc(addr, nil, time.Second)("192.0.2.10:443"); err != nil {
+		t.Fatal(err)
+	}
+	checkTarget(t, targets, "192.0.2.10:443")
+	conn.Close()
+}
+
+func TestSOCKS5DialAuth(t *testing.T) {
+	auth := &ProxyAuth{Username: "user", Password: "secret"}
+	addr, targets := socks5Proxy(t, auth, 0)
+
+	conn, err := ProxyDialFunc("socks5://user:secret@"+addr, time.Second)("backend.example:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTarget(t, targets, "backend.example:9000")
+	checkTunnel(t, conn)
+
+	_, err = SOCKS5DialFunc(addr, &ProxyAuth{Username: "user", Password: "wrong"}, time.Second)("backend.example:9000")
+	if !errors.Is(err, ErrProxyAuthFailed) {
+		t.Fatalf("dial with a wrong password: error = %v, want %v", err, ErrProxyAuthFailed)
+	}
+
+	if _, err = SOCKS5DialFunc(addr, nil, time.Second)("backend.example:9000"); !errors.Is(err, ErrProxyAuthFailed) {
+		t.Fatalf("dial without credentials: error = %v, want %v", err, ErrProxyAuthFailed)
+	}
+}
+
+func TestSOCKS5DialRefused(t *testing.T) {
+	addr, _ := socks5Proxy(t, nil, 0x05)
+
+	_, err := SOCKS5DialFunc(addr, nil, time.Second)("backend.example:9000")
+
+	var pe *ProxyDialError
+	if !errors.As(err, &pe) {
+		t.Fatalf("error = %v, want a *ProxyDialError", err)
+	}
+	if pe.Code != 0x05 || !errors.Is(err, ErrProxyConnRefused) || pe.Target != "backend.example:9000" {
+		t.Fatalf("error = %+v", pe)
+	}
+}
+
+func TestProxyDialFuncUnsupportedScheme(t *testing.T) {
+	if _, err := ProxyDialFunc("ftp://127.0.0.1:21", time.Second)("backend.example:9000"); !errors.Is(err, ErrProxyUnsupportedScheme) {
+		t.Fatalf("error = %v, want %v", err, ErrProxyUnsupportedScheme)
+	}
+}
@@ -0,0 +1,489 @@
+package knet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrProxyProtocol      = errors.New("malformed proxy protocol header")
+	ErrProxyHeaderMissing = errors.New("proxy protocol header missing")
+)
+
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+)
+
+const (
+	ProxySubTLVSSLVersion = 0x21
+	ProxySubTLVSSLCN      = 0x22
+	ProxySubTLVSSLCipher  = 0x23
+	ProxySubTLVSSLSigAlg  = 0x24
+	ProxySubTLVSSLKeyAlg  = 0x25
+)
+
+var (
+	proxyV1Sig = []byte("PROXY ")
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+type ProxyProtocolConfig struct {
+	// ReadTimeout bounds the time to receive the header, 0 means no limit.
+	ReadTimeout time.Duration
+	// TrustedUpstreams lists the load balancers allowed to send a header.
+	// Connections from anywhere else are served as is, so empty trusts
+	// none, list 0.0.0.0/0 and ::/0 to trust all.
+	TrustedUpstreams []*net.IPNet
+	// RequireHeader rejects trusted connections not starting with a header
+	// within ReadTimeout. Otherwise a connection sending nothing in time
+	// is served as having no header.
+	RequireHeader bool
+}
+
+func NewProxyProtocolConfig() *ProxyProtocolConfig {
+	return &ProxyProtocolConfig{
+		ReadTimeout: 5 * time.Second,
+	}
+}
+
+func (conf *ProxyProtocolConfig) isTrusted(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range conf.TrustedUpstreams {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses a list of CIDRs, bare IPs are taken as single hosts.
+func ParseCIDRs(cidrs ...string) (nets []*net.IPNet, err error) {
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip: %q", s)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+
+		var n *net.IPNet
+		if _, n, err = net.ParseCIDR(s); err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is the PROXY protocol header received on a connection.
+type ProxyHeader struct {
+	Version     int
+	Local       bool
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []ProxyTLV
+}
+
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (h *ProxyHeader) ALPN() string {
+	v, _ := h.TLV(ProxyTLVALPN)
+	return string(v)
+}
+
+func (h *ProxyHeader) Authority() string {
+	v, _ := h.TLV(ProxyTLVAuthority)
+	return string(v)
+}
+
+func (h *ProxyHeader) UniqueID() []byte {
+	v, _ := h.TLV(ProxyTLVUniqueID)
+	return v
+}
+
+// ProxySSLInfo describes the TLS connection terminated by the upstream.
+type ProxySSLInfo struct {
+	Client  byte
+	Verify  uint32
+	SubTLVs []ProxyTLV
+}
+
+func (i *ProxySSLInfo) SubTLV(typ byte) string {
+	for _, tlv := range i.SubTLVs {
+		if tlv.Type == typ {
+			return string(tlv.Value)
+		}
+	}
+	return ""
+}
+
+func (h *ProxyHeader) SSL() (info *ProxySSLInfo, ok bool) {
+	v, ok := h.TLV(ProxyTLVSSL)
+	if !ok || len(v) < 5 {
+		return nil, false
+	}
+
+	subTLVs, err := parseProxyTLVs(v[5:])
+	if err != nil {
+		return nil, false
+	}
+
+	info = &ProxySSLInfo{
+		Client:  v[0],
+		Verify:  binary.BigEndian.Uint32(v[1:5]),
+		SubTLVs: subTLVs,
+	}
+	return info, true
+}
+
+// ProxyListener returns a Listener whose connections report the client
+// addresses carried by the PROXY protocol v1 or v2 header sent by a
+// trusted upstream. The header is read lazily, outside of Accept.
+func ProxyListener(l net.Listener, conf *ProxyProtocolConfig) net.Listener {
+	return &proxyListener{Listener: l, conf: conf}
+}
+
+type proxyListener struct {
+	net.Listener
+	conf *ProxyProtocolConfig
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &proxyConn{
+		Conn:    c,
+		br:      bufio.NewReader(c),
+		conf:    l.conf,
+		trusted: l.conf.isTrusted(c.RemoteAddr()),
+	}
+	return pc, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	br      *bufio.Reader
+	conf    *ProxyProtocolConfig
+	trusted bool
+	once    sync.Once
+	header  *ProxyHeader
+	err     error
+
+	// read deadline set by the user, restored after reading the header
+	deadlineLock sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		if !c.trusted {
+			return
+		}
+
+		if c.conf.ReadTimeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(c.conf.ReadTimeout))
+			defer func() {
+				c.deadlineLock.Lock()
+				_ = c.Conn.SetReadDeadline(c.readDeadline)
+				c.deadlineLock.Unlock()
+			}()
+		}
+
+		c.header, c.err = readProxyHeader(c.br)
+		if c.err == nil && c.header == nil && c.conf.RequireHeader {
+			c.err = ErrProxyHeaderMissing
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.header != nil && !c.header.Local && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.init(); c.header != nil && !c.header.Local && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// ProxyHeader returns the received header, nil if there was none.
+func (c *proxyConn) ProxyHeader() *ProxyHeader {
+	c.init()
+	return c.header
+}
+
+func proxyConnOf(c net.Conn) *proxyConn {
+	pc, _ := unwrapConn(c, func(c net.Conn) bool {
+		_, ok := c.(*proxyConn)
+		return ok
+	}).(*proxyConn)
+	return pc
+}
+
+// readProxyHeader returns a nil header if the stream doesn't start with a
+// PROXY protocol signature. It peeks byte by byte so that a client waiting
+// for the server to speak first is not blocked: a timeout before the whole
+// signature arrived is no header, the peeked bytes are left to read.
+func readProxyHeader(br *bufio.Reader) (*ProxyHeader, error) {
+	for i := 1; i <= len(proxyV2Sig); i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			if err == io.EOF || isTimeout(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		v1 := i <= len(proxyV1Sig) && bytes.Equal(b, proxyV1Sig[:i])
+		v2 := bytes.Equal(b, proxyV2Sig[:i])
+
+		switch {
+		case v1 && i == len(proxyV1Sig):
+			return readProxyHeaderV1(br)
+		case v2 && i == len(proxyV2Sig):
+			return readProxyHeaderV2(br)
+		case !v1 && !v2:
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+func readProxyHeaderV1(br *bufio.Reader) (h *ProxyHeader, err error) {
+	var line []byte
+
+	// the longest v1 header is 107 bytes including the CRLF
+	for len(line) < 107 {
+		var b byte
+		if b, err = br.ReadByte(); err != nil {
+			return
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyProtocol
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, ErrProxyProtocol
+	}
+
+	h = &ProxyHeader{Version: 1}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		h.Local = true
+		return
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrProxyProtocol
+	}
+
+	if len(fields) != 6 {
+		return nil, ErrProxyProtocol
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, ErrProxyProtocol
+	}
+
+	h.Source = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	h.Destination = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (h *ProxyHeader, err error) {
+	var hdr [16]byte
+
+	if _, err = io.ReadFull(br, hdr[:]); err != nil {
+		return
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, ErrProxyProtocol
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err = io.ReadFull(br, payload); err != nil {
+		return
+	}
+
+	h = &ProxyHeader{Version: 2}
+
+	switch hdr[12] & 0x0f {
+	case 0x0:
+		h.Local = true
+		return
+	case 0x1:
+	default:
+		return nil, ErrProxyProtocol
+	}
+
+	var (
+		family = hdr[13] >> 4
+		proto  = hdr[13] & 0x0f
+		n      int
+	)
+
+	switch family {
+	case 0x1:
+		if n = 12; len(payload) < n {
+			return nil, ErrProxyProtocol
+		}
+		h.Source, h.Destination = proxyIPAddrs(proto, payload[0:4], payload[4:8], payload[8:10], payload[10:12])
+	case 0x2:
+		if n = 36; len(payload) < n {
+			return nil, ErrProxyProtocol
+		}
+		h.Source, h.Destination = proxyIPAddrs(proto, payload[0:16], payload[16:32], payload[32:34], payload[34:36])
+	case 0x3:
+		if n = 216; len(payload) < n {
+			return nil, ErrProxyProtocol
+		}
+		h.Source = &net.UnixAddr{Name: cString(payload[0:108]), Net: "unix"}
+		h.Destination = &net.UnixAddr{Name: cString(payload[108:216]), Net: "unix"}
+	case 0x0:
+		h.Local = true
+	default:
+		return nil, ErrProxyProtocol
+	}
+
+	if h.TLVs, err = parseProxyTLVs(payload[n:]); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func proxyIPAddrs(proto byte, src, dst, srcPort, dstPort []byte) (net.Addr, net.Addr) {
+	var (
+		sIP   = append(net.IP(nil), src...)
+		dIP   = append(net.IP(nil), dst...)
+		sPort = int(binary.BigEndian.Uint16(srcPort))
+		dPort = int(binary.BigEndian.Uint16(dstPort))
+	)
+
+	if proto == 0x2 {
+		return &net.UDPAddr{IP: sIP, Port: sPort}, &net.UDPAddr{IP: dIP, Port: dPort}
+	}
+	return &net.TCPAddr{IP: sIP, Port: sPort}, &net.TCPAddr{IP: dIP, Port: dPort}
+}
+
+func parseProxyTLVs(b []byte) (tlvs []ProxyTLV, err error) {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, ErrProxyProtocol
+		}
+
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, ErrProxyProtocol
+		}
+
+		tlvs = append(tlvs, ProxyTLV{Type: b[0], Value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+	return
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,129 @@
+package knet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// proxyPair returns both ends of a loopback connection accepted through a
+// ProxyListener.
+func proxyPair(t *testing.T, conf *ProxyProtocolConfig) (server, client net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := ProxyListener(ln, conf)
+	t.Cleanup(func() { pl.Close() })
+
+	if client, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = pl.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+func trustLoopback(t *testing.T) *ProxyProtocolConfig {
+	conf := NewProxyProtocolConfig()
+	nets, err := ParseCIDRs("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.TrustedUpstreams = nets
+	return conf
+}
+
+const proxyV1Header = "PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n"
+
+func TestProxyHeaderFromTrustedUpstream(t *testing.T) {
+	server, client := proxyPair(t, trustLoopback(t))
+	client.Write([]byte(proxyV1Header + "data"))
+
+	if got := server.RemoteAddr().String(); got != "203.0.113.7:56324" {
+		t.Fatalf("RemoteAddr() = %v, want the address of the header", got)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "data" {
+		t.Fatalf("Read() = %q, %v", buf, err)
+	}
+}
+
+func TestProxyHeaderUntrustedByDefault(t *testing.T) {
+	server, client := proxyPair(t, NewProxyProtocolConfig())
+	client.Write([]byte(proxyV1Header))
+
+	if got := addrIP(server.RemoteAddr()); !got.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("RemoteAddr() = %v, a forged header was trusted", server.RemoteAddr())
+	}
+
+	// the header is plain data from an untrusted peer
+	buf := make([]byte, len(proxyV1Header))
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != proxyV1Header {
+		t.Fatalf("Read() = %q, %v", buf, err)
+	}
+}
+
+func TestProxyHeaderTimeoutIsNoHeader(t *testing.T) {
+	conf := trustLoopback(t)
+	conf.ReadTimeout = 20 * time.Millisecond
+	server, client := proxyPair(t, conf)
+
+	// a client waiting for the server to speak first
+	if got := addrIP(server.RemoteAddr()); !got.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("RemoteAddr() = %v", server.RemoteAddr())
+	}
+	if h := proxyConnOf(server).ProxyHeader(); h != nil {
+		t.Fatalf("ProxyHeader() = %+v, want none", h)
+	}
+
+	client.Write([]byte("hello"))
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Read() = %q, %v after the header timed out", buf, err)
+	}
+}
+
+func TestProxyHeaderTimeoutRequired(t *testing.T) {
+	conf := trustLoopback(t)
+	conf.ReadTimeout = 20 * time.Millisecond
+	conf.RequireHeader = true
+	server, _ := proxyPair(t, conf)
+
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, ErrProxyHeaderMissing) {
+		t.Fatalf("Read() error = %v, want %v", err, ErrProxyHeaderMissing)
+	}
+}
+
+func TestProxyHeaderKeepsReadDeadline(t *testing.T) {
+	conf := trustLoopback(t)
+	conf.ReadTimeout = 20 * time.Millisecond
+	server, _ := proxyPair(t, conf)
+
+	server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !isTimeout(err) {
+			t.Fatalf("Read() error = %v, want a timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("read deadline cleared by the header read")
+	}
+}
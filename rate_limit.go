@@ -0,0 +1,362 @@
+package knet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+// TokenBucket allows rate events per second on average, with bursts of up
+// to burst events.
+type TokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// SetRate changes the rate and burst, keeping the available tokens.
+func (b *TokenBucket) SetRate(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	b.Lock()
+	b.refill(time.Now())
+	b.rate, b.burst = rate, float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.Unlock()
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if b.tokens += now.Sub(b.last).Seconds() * b.rate; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+func (b *TokenBucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+// AllowN takes n tokens if available. n larger than the burst only needs a
+// full bucket.
+func (b *TokenBucket) AllowN(n int) (ok bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now())
+
+	need := float64(n)
+	if need > b.burst {
+		need = b.burst
+	}
+
+	if ok = b.tokens >= need; ok {
+		b.tokens -= float64(n)
+	}
+	return
+}
+
+// ReserveN takes n tokens, going into debt if needed, and returns how long
+// the caller should wait for the debt to be paid.
+func (b *TokenBucket) ReserveN(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now())
+
+	if b.tokens -= float64(n); b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket is back to its burst.
+func (b *TokenBucket) full() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now())
+	return b.tokens >= b.burst
+}
+
+type RateLimitAction int
+
+const (
+	// RateLimitDelay stops reading from the session until it is back
+	// within its rate.
+	RateLimitDelay RateLimitAction = iota
+	// RateLimitDrop discards the messages above the rate.
+	RateLimitDrop
+	// RateLimitClose closes the session.
+	RateLimitClose
+)
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitDelay:
+		return "delay"
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitClose:
+		return "close"
+	}
+	return fmt.Sprintf("RateLimitAction(%d)", int(a))
+}
+
+// RateLimitError is reported to OnError when a session exceeds its rate.
+// It matches ErrRateLimited with errors.Is.
+type RateLimitError struct {
+	// Limit is "messages" or "bytes".
+	Limit  string
+	Action RateLimitAction
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v: limit=%v, action=%v", ErrRateLimited, e.Limit, e.Action)
+}
+
+func (e *RateLimitError) Is(target error) bool { return target == ErrRateLimited }
+
+// RateLimitConfig limits the connections per source and the reads per
+// session. The connections refused by the source limits have no session to
+// report to OnError, they are counted in ServerStats.RateLimited, reported
+// to Metrics.ConnRejected and logged at debug level. The sessions exceeding
+// their rates are reported to OnError, a delayed session once when it
+// starts being delayed.
+type RateLimitConfig struct {
+	// ConnRate is the new connections per second accepted from one source,
+	// with bursts of ConnBurst. 0 means no limit.
+	ConnRate  float64
+	ConnBurst int
+	// MaxConnPerSource caps the concurrent connections from one source.
+	// 0 means no limit.
+	MaxConnPerSource int
+	// IPv4Prefix and IPv6Prefix group the source addresses in subnets,
+	// e.g. 24 applies the source limits per /24. 0 means per address.
+	IPv4Prefix int
+	IPv6Prefix int
+
+	// MsgRate is the messages per second read from one session, with
+	// bursts of MsgBurst. 0 means no limit.
+	MsgRate  float64
+	MsgBurst int
+	// ByteRate is the bytes per second read from one session, with bursts
+	// of ByteBurst. 0 means no limit.
+	ByteRate  float64
+	ByteBurst int
+	// Action is taken on the sessions exceeding their rates.
+	Action RateLimitAction
+}
+
+func (conf *RateLimitConfig) limitsSources() bool {
+	return conf.ConnRate > 0 || conf.MaxConnPerSource > 0
+}
+
+func (conf *RateLimitConfig) limitsSessions() bool {
+	return conf.MsgRate > 0 || conf.ByteRate > 0
+}
+
+// sourceSweepInterval is the period idle sources are forgotten.
+const sourceSweepInterval = time.Minute
+
+type sourceState struct {
+	bucket *TokenBucket
+	conns  int
+}
+
+// sourceLimiter applies the connection limits per source address.
+type sourceLimiter struct {
+	sync.Mutex
+	conf      *RateLimitConfig
+	sources   map[string]*sourceState
+	lastSweep time.Time
+}
+
+func newSourceLimiter(conf *RateLimitConfig) *sourceLimiter {
+	return &sourceLimiter{
+		conf:      conf,
+		sources:   make(map[string]*sourceState),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *sourceLimiter) key(addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip == nil {
+		return ""
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		if l.conf.IPv4Prefix > 0 {
+			return ip4.Mask(net.CIDRMask(l.conf.IPv4Prefix, 32)).String()
+		}
+		return ip4.String()
+	}
+
+	if l.conf.IPv6Prefix > 0 {
+		return ip.Mask(net.CIDRMask(l.conf.IPv6Prefix, 128)).String()
+	}
+	return ip.String()
+}
+
+// acquire admits a connection from addr. release must be called once the
+// connection is closed.
+func (l *sourceLimiter) acquire(addr net.Addr) (release func(), err error) {
+	key := l.key(addr)
+	if key == "" {
+		return func() {}, nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.sweep()
+
+	src, ok := l.sources[key]
+	if !ok {
+		src = &sourceState{}
+		if l.conf.ConnRate > 0 {
+			src.bucket = NewTokenBucket(l.conf.ConnRate, l.conf.ConnBurst)
+		}
+		l.sources[key] = src
+	}
+
+	if l.conf.MaxConnPerSource > 0 && src.conns >= l.conf.MaxConnPerSource {
+		return nil, fmt.Errorf("%w: too many connections from %v", ErrRateLimited, key)
+	}
+
+	if src.bucket != nil && !src.bucket.Allow() {
+		return nil, fmt.Errorf("%w: connection rate exceeded from %v", ErrRateLimited, key)
+	}
+
+	src.conns++
+	return func() {
+		l.Lock()
+		src.conns--
+		l.Unlock()
+	}, nil
+}
+
+// sweep forgets the sources without connections and back to a full
+// bucket, they are no different from new ones.
+func (l *sourceLimiter) sweep() {
+	now := time.Now()
+	if now.Sub(l.lastSweep) < sourceSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, src := range l.sources {
+		if src.conns == 0 && (src.bucket == nil || src.bucket.full()) {
+			delete(l.sources, key)
+		}
+	}
+}
+
+// sessionLimiter applies the message and byte rates of one session.
+type sessionLimiter struct {
+	action    RateLimitAction
+	msgs      *TokenBucket
+	bytes     *TokenBucket
+	readBytes uint64
+	// delayed is set while the reads are delayed, the delay is reported
+	// once when it starts
+	delayed bool
+}
+
+// sessionLimiterFactory is implemented by the services limiting the read
+// rate of their sessions.
+type sessionLimiterFactory interface {
+	newSessionLimiter() *sessionLimiter
+}
+
+func newSessionLimiter(conf *RateLimitConfig) *sessionLimiter {
+	l := &sessionLimiter{action: conf.Action}
+
+	if conf.MsgRate > 0 {
+		l.msgs = NewTokenBucket(conf.MsgRate, conf.MsgBurst)
+	}
+	if conf.ByteRate > 0 {
+		l.bytes = NewTokenBucket(conf.ByteRate, conf.ByteBurst)
+	}
+	return l
+}
+
+// check accounts for the message just read. It returns false if the
+// message must be dropped, and an error if the session must be closed.
+func (l *sessionLimiter) check(s *IoSession) (ok bool, err error) {
+	readBytes := s.conn.GetReadBytes()
+	n := int(readBytes - l.readBytes)
+	l.readBytes = readBytes
+
+	if l.action == RateLimitDelay {
+		var (
+			wait  time.Duration
+			limit string
+		)
+
+		if l.msgs != nil {
+			wait, limit = l.msgs.ReserveN(1), "messages"
+		}
+		if l.bytes != nil {
+			if d := l.bytes.ReserveN(n); d > wait {
+				wait, limit = d, "bytes"
+			}
+		}
+
+		if wait > 0 {
+			if !l.delayed {
+				s.handler.OnError(s, &RateLimitError{Limit: limit, Action: l.action})
+			}
+
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+
+			select {
+			case <-s.ctx.Done():
+			case <-timer.C:
+			}
+		}
+		l.delayed = wait > 0
+		return true, nil
+	}
+
+	limit := ""
+	switch {
+	case l.msgs != nil && !l.msgs.Allow():
+		limit = "messages"
+	case l.bytes != nil && !l.bytes.AllowN(n):
+		limit = "bytes"
+	default:
+		return true, nil
+	}
+
+	if l.action == RateLimitClose {
+		return false, &RateLimitError{Limit: limit, Action: l.action}
+	}
+
+	s.handler.OnError(s, &RateLimitError{Limit: limit, Action: l.action})
+	return false, nil
+}
@@ -0,0 +1,158 @@
+package knet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitErrors waits for h to record n errors, all rate limit ones.
+func waitErrors(t *testing.T, h *recordHandler, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for len(h.Errors()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d errors reported, want %d", len(h.Errors()), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, err := range h.Errors() {
+		if !errors.Is(err, ErrRateLimited) {
+			t.Fatalf("error %v reported, want %v", err, ErrRateLimited)
+		}
+	}
+}
+
+func TestSourceLimitReported(t *testing.T) {
+	conf := NewTCPServerConfig()
+	conf.RateLimit = &RateLimitConfig{MaxConnPerSource: 1}
+	logs := captureLogs(t)
+
+	h := newRecordHandler()
+	srv := NewTCPServer(testContext(t), conf)
+	srv.SetProtocol(testProto{})
+	srv.SetIoHandler(h)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		srv.Serve(ln)
+		close(served)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-served
+		srv.Close()
+	})
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read() on the refused connection error = %v, want %v", err, io.EOF)
+	}
+
+	// a refused connection has no session to report to OnError
+	if n := srv.Stats().RateLimited; n != 1 {
+		t.Fatalf("%d connections rate limited, want 1", n)
+	}
+	if n := logs.count(LevelDebug, "connection rate limited"); n != 1 {
+		t.Fatalf("%d rate limited connections logged, want 1", n)
+	}
+	if errs := h.Errors(); len(errs) != 0 {
+		t.Fatalf("errors %v reported to the handler, want none", errs)
+	}
+}
+
+func sendMessages(t *testing.T, addr string, n int) {
+	t.Helper()
+
+	c := dialMemClient(t, addr)
+	for i := 1; i <= n; i++ {
+		if err := c.Send(context.Background(), &testMsg{id: uint64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRateLimitDelayReportedOnce(t *testing.T) {
+	var handled int32
+	h := newRecordHandler()
+	h.onMessage = func(*IoSession, Message) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}
+
+	conf := NewMemServerConfig()
+	conf.RateLimit = &RateLimitConfig{MsgRate: 50, MsgBurst: 1, Action: RateLimitDelay}
+	startMemServer(t, "rate-delay", h, conf)
+
+	sendMessages(t, "rate-delay", 5)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for atomic.LoadInt32(&handled) != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages handled, want 5", atomic.LoadInt32(&handled))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	waitErrors(t, h, 1)
+
+	if n := len(h.Errors()); n != 1 {
+		t.Fatalf("%d errors reported for one delay, want 1", n)
+	}
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	var handled int32
+	h := newRecordHandler()
+	h.onMessage = func(*IoSession, Message) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}
+
+	conf := NewMemServerConfig()
+	conf.RateLimit = &RateLimitConfig{MsgRate: 0.1, MsgBurst: 1, Action: RateLimitDrop}
+	startMemServer(t, "rate-drop", h, conf)
+
+	sendMessages(t, "rate-drop", 3)
+	waitErrors(t, h, 2)
+
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Fatalf("%d messages handled, want 1", n)
+	}
+}
+
+func TestRateLimitClose(t *testing.T) {
+	h := newRecordHandler()
+
+	conf := NewMemServerConfig()
+	conf.RateLimit = &RateLimitConfig{MsgRate: 0.1, MsgBurst: 1, Action: RateLimitClose}
+	startMemServer(t, "rate-close", h, conf)
+
+	sendMessages(t, "rate-close", 2)
+
+	reason := h.waitClosed(t)
+	if reason.Cause != CloseRateLimit || !errors.Is(reason.Err, ErrRateLimited) {
+		t.Fatalf("close reason = %v, want %v", reason, CloseRateLimit)
+	}
+}
@@ -0,0 +1,298 @@
+package knet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver produces the changing set of endpoint addresses of a service.
+// Watch sends the current set, then a new one on every change, until ctx
+// is done.
+type Resolver interface {
+	Watch(ctx context.Context) <-chan []string
+}
+
+// StaticResolver resolves to a fixed list, which can be replaced with Set.
+type StaticResolver struct {
+	sync.Mutex
+	addrs    []string
+	watchers map[chan []string]struct{}
+}
+
+func NewStaticResolver(addrs ...string) *StaticResolver {
+	return &StaticResolver{
+		addrs:    addrs,
+		watchers: make(map[chan []string]struct{}),
+	}
+}
+
+func (r *StaticResolver) Set(addrs ...string) {
+	r.Lock()
+	r.addrs = addrs
+	for ch := range r.watchers {
+		sendLatest(ch, addrs)
+	}
+	r.Unlock()
+}
+
+func (r *StaticResolver) Watch(ctx context.Context) <-chan []string {
+	ch := make(chan []string, 1)
+
+	r.Lock()
+	r.watchers[ch] = struct{}{}
+	ch <- r.addrs
+	r.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		r.Lock()
+		delete(r.watchers, ch)
+		r.Unlock()
+	}()
+	return ch
+}
+
+// sendLatest replaces a pending update not yet consumed, so a slow
+// subscriber only ever sees the most recent set.
+func sendLatest(ch chan []string, addrs []string) {
+	for {
+		select {
+		case ch <- addrs:
+			return
+		default:
+		}
+
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+type lookupFunc func(ctx context.Context) ([]string, error)
+
+// pollResolver calls lookup every interval and publishes changed results.
+// A lookup keeping state between calls is created by newLookup instead,
+// once per watcher.
+type pollResolver struct {
+	name      string
+	interval  time.Duration
+	lookup    lookupFunc
+	newLookup func() lookupFunc
+}
+
+func (r *pollResolver) Watch(ctx context.Context) <-chan []string {
+	ch := make(chan []string, 1)
+
+	lookup := r.lookup
+	if r.newLookup != nil {
+		lookup = r.newLookup()
+	}
+
+	go func() {
+		var (
+			last      []string
+			published bool
+			ticker    = time.NewTicker(r.interval)
+		)
+		defer ticker.Stop()
+
+		for {
+			addrs, err := lookup(ctx)
+			if err != nil {
+				defaultLogger.Warn("resolve failed", "resolver", r.name, "error", err)
+			} else {
+				sort.Strings(addrs)
+				if !published || !equalStrings(addrs, last) {
+					last, published = addrs, true
+					sendLatest(ch, addrs)
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return ch
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// NewDNSResolver returns a Resolver polling the A/AAAA records of host,
+// every address being joined with port. A nil r uses net.DefaultResolver.
+func NewDNSResolver(host, port string, interval time.Duration, r *net.Resolver) Resolver {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	return &pollResolver{
+		name:     "dns:" + host,
+		interval: interval,
+		lookup: func(ctx context.Context) (addrs []string, err error) {
+			var ips []string
+			if ips, err = r.LookupHost(ctx, host); err != nil {
+				return
+			}
+			for _, ip := range ips {
+				addrs = append(addrs, net.JoinHostPort(ip, port))
+			}
+			return
+		},
+	}
+}
+
+// NewSRVResolver returns a Resolver polling the SRV records of
+// _service._proto.name. A nil r uses net.DefaultResolver.
+func NewSRVResolver(service, proto, name string, interval time.Duration, r *net.Resolver) Resolver {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	return &pollResolver{
+		name:     "srv:" + name,
+		interval: interval,
+		lookup: func(ctx context.Context) (addrs []string, err error) {
+			var records []*net.SRV
+			if _, records, err = r.LookupSRV(ctx, service, proto, name); err != nil {
+				return
+			}
+			for _, srv := range records {
+				host := strings.TrimSuffix(srv.Target, ".")
+				addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+			}
+			return
+		},
+	}
+}
+
+// NewFileResolver returns a Resolver watching a file holding the endpoint
+// list, either as JSON (an array, or an object with an "endpoints" array)
+// or as a YAML sequence, optionally under an "endpoints" key.
+func NewFileResolver(path string, interval time.Duration) Resolver {
+	return &pollResolver{
+		name:      "file:" + path,
+		interval:  interval,
+		newLookup: func() lookupFunc { return fileLookup(path) },
+	}
+}
+
+// fileLookup reads the endpoint list of path, again only once the file
+// changed.
+func fileLookup(path string) lookupFunc {
+	var (
+		lastMod  time.Time
+		lastSize int64
+		last     []string
+	)
+
+	return func(ctx context.Context) (addrs []string, err error) {
+		var fi os.FileInfo
+		if fi, err = os.Stat(path); err != nil {
+			return
+		}
+
+		// a copy, the caller sorts the list it gets
+		if last != nil && fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+			return append([]string(nil), last...), nil
+		}
+
+		var data []byte
+		if data, err = os.ReadFile(path); err != nil {
+			return
+		}
+
+		if addrs, err = parseEndpointList(path, data); err != nil {
+			return
+		}
+
+		lastMod, lastSize, last = fi.ModTime(), fi.Size(), addrs
+		return append([]string(nil), addrs...), nil
+	}
+}
+
+func parseEndpointList(path string, data []byte) (addrs []string, err error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return parseYAMLEndpoints(data)
+	case ".json":
+		return parseJSONEndpoints(data)
+	}
+
+	if addrs, err = parseJSONEndpoints(data); err != nil {
+		return parseYAMLEndpoints(data)
+	}
+	return
+}
+
+func parseJSONEndpoints(data []byte) (addrs []string, err error) {
+	if err = json.Unmarshal(data, &addrs); err == nil {
+		return
+	}
+
+	var obj struct {
+		Endpoints []string `json:"endpoints"`
+	}
+	if err = json.Unmarshal(data, &obj); err != nil {
+		return
+	}
+	return obj.Endpoints, nil
+}
+
+// parseYAMLEndpoints understands the small YAML subset used for endpoint
+// lists: "- addr" items, optionally nested under one "endpoints:" key.
+// Any other line is an error, so a half-written file is never taken for
+// a shorter list.
+func parseYAMLEndpoints(data []byte) (addrs []string, err error) {
+	var keyed bool
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line == "---":
+			continue
+		case line == "endpoints:" && !keyed && len(addrs) == 0:
+			keyed = true
+			continue
+		case !strings.HasPrefix(line, "- "):
+			return nil, fmt.Errorf("endpoint list line %d: unexpected %q", n, line)
+		}
+
+		addr := strings.TrimSpace(line[2:])
+		addr = strings.Trim(addr, `"'`)
+		if addr == "" {
+			return nil, fmt.Errorf("endpoint list line %d: empty address", n)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, scanner.Err()
+}
@@ -0,0 +1,268 @@
+package knet
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	dnsTypeA   = 1
+	dnsTypeSRV = 33
+)
+
+// stubDNS answers the A and SRV queries of the Go resolver from its
+// records, any other query gets an empty answer.
+type stubDNS struct {
+	sync.Mutex
+	hosts []net.IP
+	srvs  []net.SRV
+	conn  net.PacketConn
+}
+
+func newStubDNS(t *testing.T) *stubDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	d := &stubDNS{conn: conn}
+	go d.serve()
+	return d
+}
+
+func (d *stubDNS) set(hosts []net.IP, srvs []net.SRV) {
+	d.Lock()
+	d.hosts, d.srvs = hosts, srvs
+	d.Unlock()
+}
+
+// resolver returns a net.Resolver sending every query to the stub.
+func (d *stubDNS) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", d.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (d *stubDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := d.answer(buf[:n]); resp != nil {
+			d.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (d *stubDNS) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	// the question: the labels of the name, its type and its class
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	question := query[12:end]
+	qtype := binary.BigEndian.Uint16(question[len(question)-4:])
+
+	var records [][]byte
+	d.Lock()
+	switch qtype {
+	case dnsTypeA:
+		for _, ip := range d.hosts {
+			records = append(records, ip.To4())
+		}
+	case dnsTypeSRV:
+		for _, srv := range d.srvs {
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata, srv.Priority)
+			binary.BigEndian.PutUint16(rdata[2:], srv.Weight)
+			binary.BigEndian.PutUint16(rdata[4:], srv.Port)
+			records = append(records, append(rdata, dnsName(srv.Target)...))
+		}
+	}
+	d.Unlock()
+
+	resp := make([]byte, 12, 512)
+	copy(resp, query[:2])
+	binary.BigEndian.PutUint16(resp[2:], 0x8580) // response, authoritative, recursion
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(records)))
+	resp = append(resp, question...)
+
+	for _, rdata := range records {
+		var rr [12]byte
+		binary.BigEndian.PutUint16(rr[:], 0xc00c) // the name of the question
+		binary.BigEndian.PutUint16(rr[2:], qtype)
+		binary.BigEndian.PutUint16(rr[4:], 1)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+		resp = append(resp, rr[:]...)
+		resp = append(resp, rdata...)
+	}
+	return resp
+}
+
+func dnsName(name string) (b []byte) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func waitUpdate(t *testing.T, updates <-chan []string, want ...string) {
+	t.Helper()
+
+	select {
+	case got := <-updates:
+		if !equalStrings(got, want) {
+			t.Fatalf("update = %v, want %v", got, want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no update, want %v", want)
+	}
+}
+
+func expectNoUpdate(t *testing.T, updates <-chan []string) {
+	t.Helper()
+
+	select {
+	case got := <-updates:
+		t.Fatalf("unexpected update %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDNSResolver(t *testing.T) {
+	d := newStubDNS(t)
+	d.set([]net.IP{net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1)}, nil)
+
+	r := NewDNSResolver("backend.knet.test", "80", 10*time.Millisecond, d.resolver())
+	updates := r.Watch(testContext(t))
+	waitUpdate(t, updates, "10.0.0.1:80", "10.0.0.2:80")
+
+	d.set([]net.IP{net.IPv4(10, 0, 0, 3)}, nil)
+	waitUpdate(t, updates, "10.0.0.3:80")
+
+	// an empty answer is a lookup error, the last set stands
+	d.set(nil, nil)
+	expectNoUpdate(t, updates)
+}
+
+func TestSRVResolver(t *testing.T) {
+	d := newStubDNS(t)
+	d.set(nil, []net.SRV{
+		{Target: "b.knet.test.", Port: 9001, Priority: 10, Weight: 1},
+		{Target: "a.knet.test.", Port: 9000, Priority: 10, Weight: 1},
+	})
+
+	r := NewSRVResolver("knet", "tcp", "svc.knet.test", 10*time.Millisecond, d.resolver())
+	updates := r.Watch(testContext(t))
+	waitUpdate(t, updates, "a.knet.test:9000", "b.knet.test:9001")
+
+	d.set(nil, []net.SRV{{Target: "c.knet.test.", Port: 9002}})
+	waitUpdate(t, updates, "c.knet.test:9002")
+}
+
+func TestParseEndpointList(t *testing.T) {
+	tests := []struct {
+		path string
+		data string
+		want []string
+		err  bool
+	}{
+		{path: "eps.json", data: `["a:1", "b:2"]`, want: []string{"a:1", "b:2"}},
+		{path: "eps.json", data: `{"endpoints": ["a:1"]}`, want: []string{"a:1"}},
+		{path: "eps.json", data: `["a:1", "b:`, err: true},
+		{path: "eps.yaml", data: "# backends\n- a:1\n- 'b:2'\n", want: []string{"a:1", "b:2"}},
+		{path: "eps.yaml", data: "---\nendpoints:\n  - a:1  # primary\n  - \"b:2\"\n", want: []string{"a:1", "b:2"}},
+		{path: "eps.yaml", data: "", want: nil},
+		{path: "eps.yaml", data: "endpoints:\n  - a:1\nweights:\n  - 3\n", err: true},
+		{path: "eps.yaml", data: "endpoints:\n  - a:1\n  -\n", err: true},
+		{path: "eps.yaml", data: "endpoints: [a:1, b:2]\n", err: true},
+		{path: "eps.yaml", data: "-a:1\n", err: true},
+		{path: "eps", data: `["a:1"]`, want: []string{"a:1"}},
+		{path: "eps", data: "- a:1\n", want: []string{"a:1"}},
+		{path: "eps", data: `["a:1",`, err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseEndpointList(tt.path, []byte(tt.data))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s %q: got %v, want an error", tt.path, tt.data, got)
+			}
+			continue
+		}
+		if err != nil || !equalStrings(got, tt.want) {
+			t.Errorf("%s %q: got %v, %v, want %v", tt.path, tt.data, got, err, tt.want)
+		}
+	}
+}
+
+func TestFileResolver(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "endpoints.yaml")
+
+	// replaces the file at once, a plain write could be seen empty
+	write := func(data string) {
+		tmp := filepath.Join(dir, "endpoints.tmp")
+		if err := os.WriteFile(tmp, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("endpoints:\n  - b:1\n  - a:1\n")
+	updates := NewFileResolver(path, 10*time.Millisecond).Watch(testContext(t))
+	waitUpdate(t, updates, "a:1", "b:1")
+
+	// a file caught half-written is not taken for a shorter list
+	write("endpoints:\n  - a:1\nendpo")
+	expectNoUpdate(t, updates)
+
+	write("endpoints:\n  - c:1\n")
+	waitUpdate(t, updates, "c:1")
+}
+
+func TestFileResolverConcurrentWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+	if err := os.WriteFile(path, []byte(`["b:1", "a:1"]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewFileResolver(path, time.Millisecond)
+	ctx := testContext(t)
+
+	// the watchers poll concurrently, every one gets the current list first
+	var watchers []<-chan []string
+	for i := 0; i < 4; i++ {
+		watchers = append(watchers, r.Watch(ctx))
+	}
+	for _, updates := range watchers {
+		waitUpdate(t, updates, "a:1", "b:1")
+	}
+	time.Sleep(20 * time.Millisecond)
+}
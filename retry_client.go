@@ -0,0 +1,260 @@
+package knet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+// IdempotentRequest is implemented by requests which may safely be
+// executed more than once by the server.
+type IdempotentRequest interface {
+	Idempotent() bool
+}
+
+func isIdempotent(msg Message) bool {
+	r, ok := msg.(IdempotentRequest)
+	return ok && r.Idempotent()
+}
+
+// sendTracker records whether an attempt handed its message to a session.
+// An attempt failing before that can't have been seen by the peer.
+type sendTracker struct {
+	sent   int32
+	parent *sendTracker
+}
+
+type sendTrackerKey struct{}
+
+func withSendTracker(ctx context.Context) (context.Context, *sendTracker) {
+	parent, _ := ctx.Value(sendTrackerKey{}).(*sendTracker)
+	t := &sendTracker{parent: parent}
+	return context.WithValue(ctx, sendTrackerKey{}, t), t
+}
+
+// markSent is called once a message is queued on a session with ctx.
+func markSent(ctx context.Context) {
+	t, _ := ctx.Value(sendTrackerKey{}).(*sendTracker)
+	for ; t != nil; t = t.parent {
+		atomic.StoreInt32(&t.sent, 1)
+	}
+}
+
+func (t *sendTracker) isSent() bool {
+	return atomic.LoadInt32(&t.sent) == 1
+}
+
+// DefaultRetryable classifies transport failures as retryable. Caller
+// cancellation, a closed client and application errors are not.
+func DefaultRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrClientClosed) {
+		return false
+	}
+
+	switch {
+	case errors.Is(err, ErrTimeout),
+		errors.Is(err, ErrPeerDead),
+		errors.Is(err, ErrSessionClosed),
+		errors.Is(err, ErrClientDisconnected),
+		errors.Is(err, ErrNoEndpoint),
+		errors.Is(err, ErrLimitExceeded),
+		errors.Is(err, gobreaker.ErrOpenState),
+		errors.Is(err, gobreaker.ErrTooManyRequests),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// DefaultRetryBudgetMax is the default cap of the retries a RetryBudget
+// saves up from requests.
+const DefaultRetryBudgetMax = 100
+
+// RetryBudget caps retries to a ratio of the requests, plus a minimum
+// number of retries per second, so that retries can't turn an outage into
+// a storm.
+type RetryBudget struct {
+	sync.Mutex
+	ratio       float64
+	minPerSec   float64
+	maxBalance  float64
+	balance     float64
+	reserve     float64
+	lastRefresh time.Time
+}
+
+// NewRetryBudget returns a budget earning ratio retries per request, up to
+// maxRetries saved, DefaultRetryBudgetMax if 0.
+func NewRetryBudget(ratio float64, minRetriesPerSecond, maxRetries int) *RetryBudget {
+	if maxRetries <= 0 {
+		maxRetries = DefaultRetryBudgetMax
+	}
+
+	b := &RetryBudget{
+		ratio:       ratio,
+		minPerSec:   float64(minRetriesPerSecond),
+		maxBalance:  float64(maxRetries),
+		reserve:     float64(minRetriesPerSecond),
+		lastRefresh: time.Now(),
+	}
+	return b
+}
+
+// Deposit credits the budget for one request.
+func (b *RetryBudget) Deposit() {
+	b.Lock()
+	if b.balance += b.ratio; b.balance > b.maxBalance {
+		b.balance = b.maxBalance
+	}
+	b.Unlock()
+}
+
+// Withdraw takes one retry from the budget, it returns false if the budget
+// is exhausted.
+func (b *RetryBudget) Withdraw() (ok bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	if b.reserve += now.Sub(b.lastRefresh).Seconds() * b.minPerSec; b.reserve > b.minPerSec {
+		b.reserve = b.minPerSec
+	}
+	b.lastRefresh = now
+
+	switch {
+	case b.reserve >= 1:
+		b.reserve--
+		return true
+	case b.balance >= 1:
+		b.balance--
+		return true
+	}
+	return false
+}
+
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt.
+	MaxAttempts       int
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	// Jitter randomizes each backoff by up to this fraction.
+	Jitter float64
+	// Retryable classifies errors, DefaultRetryable if nil. Errors after the
+	// request was queued on a session are only retried for idempotent
+	// requests anyway.
+	Retryable func(err error) bool
+	Budget    *RetryBudget
+}
+
+func NewRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:       3,
+		InitialBackoff:    10 * time.Millisecond,
+		MaxBackoff:        time.Second,
+		BackoffMultiplier: 2,
+		Jitter:            0.2,
+		Budget:            NewRetryBudget(0.2, 10, DefaultRetryBudgetMax),
+	}
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		d *= p.BackoffMultiplier
+	}
+	if max := float64(p.MaxBackoff); p.MaxBackoff > 0 && d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+func (p *RetryPolicy) shouldRetry(msg Message, err error, sent bool) bool {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = DefaultRetryable
+	}
+
+	if !retryable(err) {
+		return false
+	}
+	return !sent || isIdempotent(msg)
+}
+
+// RetryClient retries failed calls according to a RetryPolicy.
+type RetryClient struct {
+	policy *RetryPolicy
+	Client
+}
+
+func NewRetryClient(client Client, policy *RetryPolicy) *RetryClient {
+	return &RetryClient{
+		Client: client,
+		policy: policy,
+	}
+}
+
+func (c *RetryClient) Call(ctx context.Context, req Request) (Response, error) {
+	return c.CallWithTimeout(ctx, req, 0)
+}
+
+func (c *RetryClient) CallWithTimeout(ctx context.Context, req Request, timeout time.Duration) (resp Response, err error) {
+	err = c.retry(ctx, req, func(ctx context.Context) (err error) {
+		resp, err = c.Client.CallWithTimeout(ctx, req, timeout)
+		return
+	})
+	return
+}
+
+func (c *RetryClient) Send(ctx context.Context, msg Message) error {
+	return c.SendWithTimeout(ctx, msg, 0)
+}
+
+func (c *RetryClient) SendWithTimeout(ctx context.Context, msg Message, timeout time.Duration) error {
+	return c.retry(ctx, msg, func(ctx context.Context) error {
+		return c.Client.SendWithTimeout(ctx, msg, timeout)
+	})
+}
+
+func (c *RetryClient) retry(ctx context.Context, msg Message, do func(context.Context) error) (err error) {
+	if budget := c.policy.Budget; budget != nil {
+		budget.Deposit()
+	}
+
+	for attempt := 1; ; attempt++ {
+		actx, tracker := withSendTracker(ctx)
+		if err = do(actx); err == nil {
+			return
+		}
+
+		if attempt >= c.policy.MaxAttempts || !c.policy.shouldRetry(msg, err, tracker.isSent()) {
+			return
+		}
+
+		if budget := c.policy.Budget; budget != nil && !budget.Withdraw() {
+			return
+		}
+
+		timer := time.NewTimer(c.policy.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package knet
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingCalls counts the calls reaching the wrapped client.
+type countingCalls struct {
+	Client
+	calls int32
+}
+
+func (c *countingCalls) CallWithTimeout(ctx context.Context, req Request, timeout time.Duration) (Response, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return c.Client.CallWithTimeout(ctx, req, timeout)
+}
+
+func testRetryPolicy() *RetryPolicy {
+	policy := NewRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	policy.Budget = nil
+	return policy
+}
+
+func TestRetryNotSent(t *testing.T) {
+	c := &countingCalls{Client: &errClient{err: ErrNoEndpoint}}
+
+	_, err := NewRetryClient(c, testRetryPolicy()).Call(context.Background(), &testMsg{id: 1})
+	if err != ErrNoEndpoint {
+		t.Fatalf("Call() error = %v, want %v", err, ErrNoEndpoint)
+	}
+	if c.calls != 3 {
+		t.Fatalf("%d attempts of a request never sent, want 3", c.calls)
+	}
+}
+
+func TestRetryClientClosed(t *testing.T) {
+	startMemServer(t, "retry-closed", &echoHandler{}, nil)
+	mc := dialMemClient(t, "retry-closed")
+	mc.Close()
+
+	c := &countingCalls{Client: mc}
+	_, err := NewRetryClient(c, testRetryPolicy()).Call(context.Background(), &testMsg{id: 1})
+	if err != ErrClientClosed {
+		t.Fatalf("Call() error = %v, want %v", err, ErrClientClosed)
+	}
+	if c.calls != 1 {
+		t.Fatalf("%d attempts on a closed client, want 1", c.calls)
+	}
+}
+
+func TestRetrySent(t *testing.T) {
+	var received int32
+	h := newRecordHandler()
+	h.onMessage = func(*IoSession, Message) error {
+		atomic.AddInt32(&received, 1)
+		return nil
+	}
+	startMemServer(t, "retry-sent", h, nil)
+
+	c := &countingCalls{Client: dialMemClient(t, "retry-sent")}
+	rc := NewRetryClient(c, testRetryPolicy())
+
+	// a request sent without reply is not sent again
+	if _, err := rc.CallWithTimeout(context.Background(), &testMsg{id: 1}, 20*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("CallWithTimeout() error = %v, want %v", err, ErrTimeout)
+	}
+	if c.calls != 1 {
+		t.Fatalf("%d attempts of a sent request, want 1", c.calls)
+	}
+
+	// unless it is idempotent
+	if _, err := rc.CallWithTimeout(context.Background(), &testMsg{id: 2, idempotent: true}, 20*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("CallWithTimeout() error = %v, want %v", err, ErrTimeout)
+	}
+	if c.calls != 4 {
+		t.Fatalf("%d attempts of an idempotent request, want 3", c.calls-1)
+	}
+	if n := atomic.LoadInt32(&received); n != 4 {
+		t.Fatalf("server received %d requests, want 4", n)
+	}
+}
+
+func TestRetryBudgetMax(t *testing.T) {
+	b := NewRetryBudget(1, 0, 2)
+	for i := 0; i < 5; i++ {
+		b.Deposit()
+	}
+
+	for i := 0; i < 2; i++ {
+		if !b.Withdraw() {
+			t.Fatalf("withdraw %d refused", i)
+		}
+	}
+	if b.Withdraw() {
+		t.Fatal("budget saved more than its max")
+	}
+}
@@ -2,9 +2,11 @@ package knet
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,20 +21,55 @@ type ServerConfig struct {
 		ReadTimeout   time.Duration
 		WriteTimeout  time.Duration
 	}
-	MaxConnection int
+	MaxConnection    int
+	TLSConfig        *tls.Config
+	HandshakeTimeout time.Duration
+	ProxyProtocol    *ProxyProtocolConfig
+	// Overload enables load shedding, nil disables it.
+	Overload *OverloadConfig
+	// RateLimit limits the connections per source and the read rate of
+	// the sessions, nil disables it.
+	RateLimit *RateLimitConfig
+	// AccessControl refuses connections by remote address, nil allows all.
+	// Connections behind the PROXY protocol are checked against the client
+	// address once the header is read.
+	AccessControl *AccessControl
 }
 
 func NewServerConfig() *ServerConfig {
 	conf := &ServerConfig{}
 	conf.Io.SendQueueSize = 16
 	conf.Io.RecvQueueSize = 16
+	conf.HandshakeTimeout = 10 * time.Second
 	return conf
 }
 
+type ServerStats struct {
+	Accepted uint64
+	// Rejected counts the connections closed while overloaded.
+	Rejected uint64
+	InFlight int64
+	// Shed counts the messages shed while overloaded.
+	Shed         uint64
+	QueueLatency time.Duration
+	// RateLimited counts the connections refused by the source limits.
+	RateLimited uint64
+	// Denied counts the connections refused by the access control.
+	Denied uint64
+}
+
 type ServerBase struct {
+	// 64-bit atomic fields first, for alignment on 32-bit platforms
+	accepted uint64
+	rejected uint64
+	limited  uint64
+	denied   uint64
+	loadTracker
+
 	*IoServiceBase
-	listen ListenFunc
-	conf   *ServerConfig
+	listen  ListenFunc
+	conf    *ServerConfig
+	sources *sourceLimiter
 
 	ctx       context.Context
 	cancel    context.CancelFunc
@@ -50,11 +87,16 @@ func NewServerBase(ctx context.Context, listen ListenFunc, conf *ServerConfig) *
 
 	srv := &ServerBase{
 		IoServiceBase: NewIoServiceBase(ioConf),
+		loadTracker:   loadTracker{overload: conf.Overload},
 		listen:        listen,
 		conf:          conf,
 		ctx:           newctx,
 		cancel:        cancel,
 	}
+
+	if conf.RateLimit != nil && conf.RateLimit.limitsSources() {
+		srv.sources = newSourceLimiter(conf.RateLimit)
+	}
 	return srv
 }
 
@@ -68,6 +110,14 @@ func (srv *ServerBase) ListenAndServe(addr string) error {
 		return err
 	}
 
+	if srv.conf.ProxyProtocol != nil {
+		ln = ProxyListener(ln, srv.conf.ProxyProtocol)
+	}
+
+	if srv.conf.TLSConfig != nil {
+		ln = tls.NewListener(ln, srv.conf.TLSConfig)
+	}
+
 	if srv.conf.MaxConnection > 0 {
 		ln = LimitListener(ln, srv.conf.MaxConnection)
 	}
@@ -101,7 +151,7 @@ func (srv *ServerBase) Serve(l net.Listener) error {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				defaultLogger.Printf("Accept error: %v; retrying in %v", err, tempDelay)
+				defaultLogger.Warn("accept failed", "error", err, "retry_in", tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
@@ -110,9 +160,21 @@ func (srv *ServerBase) Serve(l net.Listener) error {
 		}
 
 		tempDelay = 0
-		session := srv.newSession(conn)
+		atomic.AddUint64(&srv.accepted, 1)
+
+		if srv.conf.Overload != nil && srv.conf.Overload.RejectConnections && srv.overloaded() {
+			atomic.AddUint64(&srv.rejected, 1)
+			srv.connRejected("overload")
+			conn.Close()
+			continue
+		}
+
+		if srv.conf.AccessControl != nil && proxyConnOf(conn) == nil && !srv.allowed(conn) {
+			continue
+		}
+
 		srv.wg.Add(1)
-		go srv.serve(session)
+		go srv.serve(conn)
 	}
 }
 
@@ -123,6 +185,36 @@ func (srv *ServerBase) Close() {
 	})
 }
 
+func (srv *ServerBase) Stats() ServerStats {
+	return ServerStats{
+		Accepted:     atomic.LoadUint64(&srv.accepted),
+		Rejected:     atomic.LoadUint64(&srv.rejected),
+		InFlight:     atomic.LoadInt64(&srv.inflight),
+		Shed:         atomic.LoadUint64(&srv.shed),
+		QueueLatency: time.Duration(atomic.LoadInt64(&srv.queueLatency)),
+		RateLimited:  atomic.LoadUint64(&srv.limited),
+		Denied:       atomic.LoadUint64(&srv.denied),
+	}
+}
+
+func (srv *ServerBase) connRejected(reason string) {
+	if m := srv.metrics(); m != nil {
+		m.ConnRejected(reason)
+	}
+}
+
+// allowed applies the access control to conn, closing it if refused.
+func (srv *ServerBase) allowed(conn net.Conn) bool {
+	if srv.conf.AccessControl.Allowed(conn.RemoteAddr()) {
+		return true
+	}
+
+	atomic.AddUint64(&srv.denied, 1)
+	srv.connRejected("access_denied")
+	conn.Close()
+	return false
+}
+
 func (srv *ServerBase) AddRef() {
 	srv.wg.Add(1)
 }
@@ -136,13 +228,50 @@ func (srv *ServerBase) newSession(conn net.Conn) *IoSession {
 	return session
 }
 
-func (srv *ServerBase) serve(session *IoSession) {
+func (srv *ServerBase) shedder() loadShedder {
+	if srv.conf.Overload != nil {
+		return &srv.loadTracker
+	}
+	return nil
+}
+
+func (srv *ServerBase) newSessionLimiter() *sessionLimiter {
+	if conf := srv.conf.RateLimit; conf != nil && conf.limitsSessions() {
+		return newSessionLimiter(conf)
+	}
+	return nil
+}
+
+func (srv *ServerBase) serve(conn net.Conn) {
 	defer func() {
 		if r := recover(); r != nil {
-			defaultLogger.Printf("got panic in serve session: error=%v, stack=%v", getPanicStack())
+			defaultLogger.Error("got panic in serve session", "error", r, "stack", getPanicStack())
 		}
 		srv.wg.Done()
 	}()
 
-	session.Open()
+	// reading the PROXY header may block, so it wasn't checked in Serve
+	if srv.conf.AccessControl != nil && proxyConnOf(conn) != nil && !srv.allowed(conn) {
+		return
+	}
+
+	if srv.sources != nil {
+		release, err := srv.sources.acquire(conn.RemoteAddr())
+		if err != nil {
+			atomic.AddUint64(&srv.limited, 1)
+			srv.connRejected("rate_limit")
+			defaultLogger.Debug("connection rate limited", "remote_addr", conn.RemoteAddr(), "error", err)
+			conn.Close()
+			return
+		}
+		conn = &limitListenerConn{Conn: conn, release: release}
+	}
+
+	if err := tlsHandshake(srv.ctx, conn, srv.conf.HandshakeTimeout); err != nil {
+		defaultLogger.Warn("tls handshake failed", "remote_addr", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+
+	srv.newSession(conn).Open()
 }
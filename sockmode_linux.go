@@ -0,0 +1,16 @@
+//go:build linux
+
+package knet
+
+import "syscall"
+
+// restrictSocketMode makes a unix socket bound accessible to its owner
+// only, Linux creates the socket file with the mode of the socket.
+func restrictSocketMode(network, address string, c syscall.RawConn) (err error) {
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.Fchmod(int(fd), 0600)
+	}); cerr != nil {
+		return cerr
+	}
+	return
+}
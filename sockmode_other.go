@@ -0,0 +1,11 @@
+//go:build !linux
+
+package knet
+
+import "syscall"
+
+// restrictSocketMode does nothing, the mode of a socket doesn't apply to
+// its file on this platform.
+func restrictSocketMode(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -3,6 +3,7 @@ package knet
 import (
 	"context"
 	"net"
+	"time"
 )
 
 type TCPServerConfig ServerConfig
@@ -23,6 +24,7 @@ func NewTCPServerConfig() *TCPServerConfig {
 	conf := &TCPServerConfig{}
 	conf.Io.SendQueueSize = 16
 	conf.Io.RecvQueueSize = 16
+	conf.HandshakeTimeout = 10 * time.Second
 	return conf
 }
 
@@ -0,0 +1,57 @@
+package knet
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+type netConnUnwrapper interface {
+	NetConn() net.Conn
+}
+
+// unwrapConn walks down the wrapper chain of c and returns the first
+// conn accepted by match, or nil if none is found.
+func unwrapConn(c net.Conn, match func(net.Conn) bool) net.Conn {
+	for c != nil {
+		if match(c) {
+			return c
+		}
+
+		u, ok := c.(netConnUnwrapper)
+		if !ok {
+			return nil
+		}
+		c = u.NetConn()
+	}
+	return nil
+}
+
+func tlsConnOf(c net.Conn) *tls.Conn {
+	tc, _ := unwrapConn(c, func(c net.Conn) bool {
+		_, ok := c.(*tls.Conn)
+		return ok
+	}).(*tls.Conn)
+	return tc
+}
+
+func tlsHandshake(ctx context.Context, conn net.Conn, timeout time.Duration) (err error) {
+	tc := tlsConnOf(conn)
+	if tc == nil {
+		return
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return tc.HandshakeContext(ctx)
+}
+
+func TLSDialFunc(timeout time.Duration, config *tls.Config) DialFunc {
+	return func(addr string) (conn net.Conn, err error) {
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, config)
+	}
+}
@@ -0,0 +1,220 @@
+package knet
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signing the next ones if a CA.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate named cn, signed by parent or self
+// signed if nil.
+func newTestCert(t *testing.T, cn string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+func (c *testCert) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+// startTLSServer serves h over mutual TLS, the clients must present a
+// certificate signed by ca.
+func startTLSServer(t *testing.T, ca *testCert, h IoHandler) string {
+	t.Helper()
+
+	conf := NewTCPServerConfig()
+	conf.HandshakeTimeout = 100 * time.Millisecond
+	conf.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{newTestCert(t, "server", ca, false).tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+	}
+
+	srv := NewTCPServer(testContext(t), conf)
+	srv.SetProtocol(testProto{})
+	srv.SetIoHandler(h)
+
+	ln, err := TCPListen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = tls.NewListener(ln, conf.TLSConfig)
+
+	served := make(chan struct{})
+	go func() {
+		srv.Serve(ln)
+		close(served)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-served
+		srv.Close()
+	})
+	return ln.Addr().String()
+}
+
+func dialTLSClient(t *testing.T, addr string, ca, cert *testCert) (*TCPClient, error) {
+	conf := NewTCPClientConfig()
+	conf.DialTimeout = time.Second
+	conf.TLSConfig = &tls.Config{
+		RootCAs:      ca.pool(),
+		Certificates: []tls.Certificate{cert.tlsCertificate()},
+	}
+
+	c := NewTCPClient(testContext(t), conf)
+	c.SetProtocol(testProto{})
+	t.Cleanup(c.Close)
+	return c, c.Dial(addr)
+}
+
+func TestTLSMutualAuth(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+
+	peers := make(chan []*x509.Certificate, 1)
+	h := newRecordHandler()
+	h.onMessage = func(s *IoSession, m Message) error {
+		peers <- s.PeerCertificates()
+		msg := *m.(*testMsg)
+		return s.Send(s.MessageContext(), &msg)
+	}
+	addr := startTLSServer(t, ca, h)
+
+	c, err := dialTLSClient(t, addr, ca, newTestCert(t, "client", ca, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.Call(context.Background(), &testMsg{id: 1, body: "hello"})
+	if err != nil || resp.(*testMsg).body != "hello" {
+		t.Fatalf("Call() = %v, %v, want the echo", resp, err)
+	}
+
+	state, ok := c.GetSession().ConnectionState()
+	if !ok || !state.HandshakeComplete {
+		t.Fatalf("ConnectionState() = %+v, %v, want a complete handshake", state, ok)
+	}
+	if len(state.PeerCertificates) == 0 || state.PeerCertificates[0].Subject.CommonName != "server" {
+		t.Fatal("client session without the server certificate")
+	}
+
+	if certs := <-peers; len(certs) == 0 || certs[0].Subject.CommonName != "client" {
+		t.Fatalf("server session peer certificates = %v, want the client one", certs)
+	}
+}
+
+func TestTLSRejectsUnknownClient(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+
+	connected := make(chan struct{}, 1)
+	h := newRecordHandler()
+	h.onConnected = func(*IoSession) error {
+		connected <- struct{}{}
+		return nil
+	}
+	addr := startTLSServer(t, ca, h)
+
+	// a client certificate from another authority
+	rogue := newTestCert(t, "rogue", newTestCert(t, "other ca", nil, true), false)
+
+	// the server may only refuse the certificate after the client is done
+	c, err := dialTLSClient(t, addr, ca, rogue)
+	if err == nil {
+		_, err = c.CallWithTimeout(context.Background(), &testMsg{id: 1}, time.Second)
+	}
+	if err == nil {
+		t.Fatal("call succeeded with a rejected client certificate")
+	}
+
+	select {
+	case <-connected:
+		t.Fatal("session opened for a rejected client")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+
+	connected := make(chan struct{}, 1)
+	h := newRecordHandler()
+	h.onConnected = func(*IoSession) error {
+		connected <- struct{}{}
+		return nil
+	}
+	addr := startTLSServer(t, ca, h)
+
+	// a client never starting the handshake
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tBegin := time.Now()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); isTimeout(err) {
+		t.Fatal("connection not closed after the handshake timeout")
+	}
+	if elapsed := time.Since(tBegin); elapsed > time.Second {
+		t.Fatalf("connection closed after %v, want about the handshake timeout", elapsed)
+	}
+
+	select {
+	case <-connected:
+		t.Fatal("session opened without a handshake")
+	default:
+	}
+}
@@ -0,0 +1,117 @@
+package knet
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Span names passed to Tracer.StartSpan.
+const (
+	// SpanCall covers a client call, from send to response.
+	SpanCall = "knet.call"
+	// SpanWrite covers the encoding and the write of a message.
+	SpanWrite = "knet.write"
+	// SpanDecode covers the read and the decoding of a message, starting
+	// when its first bytes arrived.
+	SpanDecode = "knet.decode"
+	// SpanHandle covers IoHandler.OnMessage.
+	SpanHandle = "knet.handle"
+)
+
+// Span is a traced operation, ended once with its result.
+type Span interface {
+	End(err error)
+}
+
+// Tracer starts the spans of the messages of a service. It is meant to be
+// adapted to a tracing library, knet doesn't depend on any.
+type Tracer interface {
+	// StartSpan starts a span named name at start, as a child of the span
+	// in ctx, and returns the context holding the new span. session is nil
+	// for a call made before the client is connected, msg is nil for a
+	// failed decode.
+	StartSpan(ctx context.Context, name string, start time.Time, session *IoSession, msg Message) (context.Context, Span)
+	// Inject writes the trace context of ctx to header.
+	Inject(ctx context.Context, header MessageHeader)
+	// Extract returns ctx with the trace context read from header.
+	Extract(ctx context.Context, header MessageHeader) context.Context
+}
+
+// MessageHeader is a set of string headers carried by a message, such as
+// a trace id.
+type MessageHeader interface {
+	Get(key string) string
+	Set(key, value string)
+	Keys() []string
+}
+
+// MapHeader is a MessageHeader held in a map.
+type MapHeader map[string]string
+
+func (h MapHeader) Get(key string) string { return h[key] }
+
+func (h MapHeader) Set(key, value string) { h[key] = value }
+
+func (h MapHeader) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// HeaderProtocol is implemented by the protocols whose messages carry
+// headers, which the tracer uses to propagate the trace context to the
+// peer.
+type HeaderProtocol interface {
+	// MessageHeader returns the headers of a decoded msg, nil if msg has
+	// none.
+	MessageHeader(msg Message) MessageHeader
+	// EncodeHeader encodes msg as Encode does, with header added to its
+	// headers. msg still belongs to the sender and must not be modified.
+	EncodeHeader(s *IoSession, msg Message, header MessageHeader) ([]byte, error)
+}
+
+// tracerProvider is implemented by the services tracing their messages.
+type tracerProvider interface {
+	tracer() Tracer
+}
+
+// encode encodes m, with the trace context of ctx added to its headers if
+// the protocol carries any.
+func (s *IoSession) encode(ctx context.Context, m Message) ([]byte, error) {
+	if hp, ok := s.protocol.(HeaderProtocol); ok && s.tracer != nil {
+		h := make(MapHeader)
+		s.tracer.Inject(ctx, h)
+		return hp.EncodeHeader(s, m, h)
+	}
+	return s.protocol.Encode(s, m)
+}
+
+// messageHeader returns the headers of m, nil if the protocol doesn't
+// carry any.
+func (s *IoSession) messageHeader(m Message) MessageHeader {
+	if hp, ok := s.protocol.(HeaderProtocol); ok && m != nil {
+		return hp.MessageHeader(m)
+	}
+	return nil
+}
+
+// traceDecode ends the decode span of m, started when its first bytes
+// arrived, and returns the context of m extracted from its headers.
+func (s *IoSession) traceDecode(start time.Time, m Message, err error) context.Context {
+	ctx := s.ctx
+	if h := s.messageHeader(m); h != nil {
+		ctx = s.tracer.Extract(ctx, h)
+	}
+
+	if start.IsZero() {
+		start = time.Now()
+	}
+
+	_, span := s.tracer.StartSpan(ctx, SpanDecode, start, s, m)
+	span.End(err)
+	return ctx
+}
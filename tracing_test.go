@@ -0,0 +1,103 @@
+package knet
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type traceKey struct{}
+
+type testSpan struct {
+	t    *testTracer
+	name string
+}
+
+func (s *testSpan) End(err error) {
+	s.t.lock.Lock()
+	s.t.ended = append(s.t.ended, s.name)
+	s.t.lock.Unlock()
+}
+
+// testTracer propagates the trace id held in the context.
+type testTracer struct {
+	lock  sync.Mutex
+	ended []string
+}
+
+func (t *testTracer) StartSpan(ctx context.Context, name string, start time.Time, session *IoSession, msg Message) (context.Context, Span) {
+	return ctx, &testSpan{t: t, name: name}
+}
+
+func (t *testTracer) Inject(ctx context.Context, h MessageHeader) {
+	if id, ok := ctx.Value(traceKey{}).(string); ok {
+		h.Set("trace", id)
+	}
+}
+
+func (t *testTracer) Extract(ctx context.Context, h MessageHeader) context.Context {
+	if id := h.Get("trace"); id != "" {
+		return context.WithValue(ctx, traceKey{}, id)
+	}
+	return ctx
+}
+
+func (t *testTracer) spans() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]string(nil), t.ended...)
+}
+
+func TestTracePropagation(t *testing.T) {
+	traces := make(chan interface{}, 1)
+	h := newRecordHandler()
+	h.onMessage = func(s *IoSession, m Message) error {
+		traces <- s.MessageContext().Value(traceKey{})
+		msg := *m.(*testMsg)
+		return s.Send(s.MessageContext(), &msg)
+	}
+
+	srv := startMemServer(t, "trace-propagation", h, nil)
+	srv.SetTracer(&testTracer{})
+
+	tracer := &testTracer{}
+	c := NewMemClient(testContext(t), NewMemClientConfig())
+	c.SetProtocol(testProto{})
+	c.SetTracer(tracer)
+	if err := c.Dial("trace-propagation"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := &testMsg{id: 1, body: "traced"}
+	ctx := context.WithValue(context.Background(), traceKey{}, "trace-1")
+	resp, err := c.CallWithTimeout(ctx, req, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-traces; got != "trace-1" {
+		t.Fatalf("server trace = %v, want trace-1", got)
+	}
+	if got := resp.(*testMsg).trace; got != "trace-1" {
+		t.Fatalf("reply trace header = %q, want trace-1", got)
+	}
+	if req.trace != "" {
+		t.Fatalf("request modified with trace header %q", req.trace)
+	}
+
+	want := map[string]bool{SpanCall: true, SpanWrite: true, SpanDecode: true}
+	for deadline := time.Now().Add(time.Second); ; {
+		for _, name := range tracer.spans() {
+			delete(want, name)
+		}
+		if len(want) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client spans %v, missing %v", tracer.spans(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
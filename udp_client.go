@@ -0,0 +1,42 @@
+package knet
+
+import (
+	"context"
+	"time"
+)
+
+type UDPClientConfig struct {
+	Io struct {
+		SendQueueSize int
+		RecvQueueSize int
+		ReadTimeout   time.Duration
+		WriteTimeout  time.Duration
+	}
+	MaxDatagramSize int
+	AutoReconnect   bool
+	MaxInFlight     int
+}
+
+func NewUDPClientConfig() *UDPClientConfig {
+	conf := &UDPClientConfig{}
+	conf.Io.SendQueueSize = 16
+	conf.Io.RecvQueueSize = 16
+	conf.MaxDatagramSize = MaxUDPDatagramSize
+	return conf
+}
+
+type UDPClient struct {
+	*ClientBase
+}
+
+func NewUDPClient(ctx context.Context, conf *UDPClientConfig) *UDPClient {
+	clientConf := &ClientConfig{}
+	clientConf.Io = conf.Io
+	clientConf.AutoReconnect = conf.AutoReconnect
+	clientConf.MaxInFlight = conf.MaxInFlight
+
+	c := &UDPClient{
+		ClientBase: NewClientBase(ctx, UDPDialFunc(conf.MaxDatagramSize), clientConf),
+	}
+	return c
+}
@@ -0,0 +1,346 @@
+package knet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const MaxUDPDatagramSize = 65507
+
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+type packetReader interface {
+	ReadPacket() ([]byte, error)
+}
+
+// UDPListenFunc returns a ListenFunc that demultiplexes datagrams by remote
+// address into virtual connections. Each virtual connection delivers one
+// datagram per read and is closed after idleTimeout without any traffic.
+func UDPListenFunc(maxDatagramSize int, idleTimeout time.Duration) ListenFunc {
+	return func(addr string) (ln net.Listener, err error) {
+		var pc net.PacketConn
+		if pc, err = net.ListenPacket("udp", addr); err != nil {
+			return
+		}
+
+		if maxDatagramSize <= 0 || maxDatagramSize > MaxUDPDatagramSize {
+			maxDatagramSize = MaxUDPDatagramSize
+		}
+
+		l := &udpListener{
+			pc:          pc,
+			maxSize:     maxDatagramSize,
+			idleTimeout: idleTimeout,
+			conns:       make(map[string]*udpConn),
+			acceptCh:    make(chan *udpConn, 128),
+			done:        make(chan struct{}),
+		}
+		go l.readLoop()
+		return l, nil
+	}
+}
+
+type udpListener struct {
+	sync.Mutex
+	pc          net.PacketConn
+	maxSize     int
+	idleTimeout time.Duration
+	conns       map[string]*udpConn
+	acceptCh    chan *udpConn
+	err         error
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.acceptCh:
+		return c, nil
+	case <-l.done:
+		l.Lock()
+		err := l.err
+		l.Unlock()
+		return nil, err
+	}
+}
+
+func (l *udpListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.Lock()
+		if l.err == nil {
+			l.err = net.ErrClosed
+		}
+		conns := l.conns
+		l.conns = make(map[string]*udpConn)
+		l.Unlock()
+
+		close(l.done)
+		l.pc.Close()
+
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return nil
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func (l *udpListener) readLoop() {
+	buf := make([]byte, l.maxSize+1)
+
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+
+			l.Lock()
+			if l.err == nil {
+				l.err = err
+			}
+			l.Unlock()
+			l.Close()
+			return
+		}
+
+		// oversized datagrams were truncated by the kernel, drop them
+		if n > l.maxSize {
+			continue
+		}
+
+		c, isNew := l.getConn(addr)
+		if c == nil {
+			continue
+		}
+
+		// never block the reader on Accept, it would stall every peer,
+		// drop the new one instead
+		if isNew {
+			select {
+			case l.acceptCh <- c:
+			default:
+				c.Close()
+				continue
+			}
+		}
+
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		c.deliver(pkt)
+	}
+}
+
+func (l *udpListener) getConn(addr net.Addr) (c *udpConn, isNew bool) {
+	key := addr.String()
+
+	l.Lock()
+	defer l.Unlock()
+
+	select {
+	case <-l.done:
+		return nil, false
+	default:
+	}
+
+	if c = l.conns[key]; c != nil {
+		return
+	}
+
+	c = newUDPConn(l, addr)
+	l.conns[key] = c
+	return c, true
+}
+
+func (l *udpListener) removeConn(c *udpConn) {
+	key := c.raddr.String()
+
+	l.Lock()
+	if l.conns[key] == c {
+		delete(l.conns, key)
+	}
+	l.Unlock()
+}
+
+type udpConn struct {
+	l            *udpListener
+	raddr        net.Addr
+	packets      chan []byte
+	readDeadline atomic.Value
+	lastActive   int64
+	idleTimer    *time.Timer
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func newUDPConn(l *udpListener, raddr net.Addr) *udpConn {
+	c := &udpConn{
+		l:          l,
+		raddr:      raddr,
+		packets:    make(chan []byte, 64),
+		lastActive: time.Now().UnixNano(),
+		done:       make(chan struct{}),
+	}
+	c.readDeadline.Store(time.Time{})
+
+	if l.idleTimeout > 0 {
+		c.idleTimer = time.AfterFunc(l.idleTimeout, c.checkIdle)
+	}
+	return c
+}
+
+func (c *udpConn) checkIdle() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+	if idle >= c.l.idleTimeout {
+		c.Close()
+		return
+	}
+	c.idleTimer.Reset(c.l.idleTimeout - idle)
+}
+
+func (c *udpConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+func (c *udpConn) deliver(pkt []byte) {
+	c.touch()
+
+	// like the network itself, drop datagrams when the receiver lags behind
+	select {
+	case c.packets <- pkt:
+	case <-c.done:
+	default:
+	}
+}
+
+func (c *udpConn) ReadPacket() (pkt []byte, err error) {
+	var timeout <-chan time.Time
+
+	if deadline := c.readDeadline.Load().(time.Time); !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case pkt = <-c.packets:
+		return
+	case <-c.done:
+		return nil, io.EOF
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *udpConn) Read(b []byte) (n int, err error) {
+	var pkt []byte
+	if pkt, err = c.ReadPacket(); err != nil {
+		return
+	}
+	return copy(b, pkt), nil
+}
+
+func (c *udpConn) Write(b []byte) (n int, err error) {
+	if len(b) > c.l.maxSize {
+		return 0, ErrDatagramTooLarge
+	}
+
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.touch()
+	return c.l.pc.WriteTo(b, c.raddr)
+}
+
+func (c *udpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		c.l.removeConn(c)
+	})
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.l.pc.LocalAddr()
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// UDPDialFunc returns a DialFunc for a connected UDP socket talking to a
+// single peer, one datagram per Decode and one datagram per Encode.
+func UDPDialFunc(maxDatagramSize int) DialFunc {
+	if maxDatagramSize <= 0 || maxDatagramSize > MaxUDPDatagramSize {
+		maxDatagramSize = MaxUDPDatagramSize
+	}
+
+	return func(addr string) (conn net.Conn, err error) {
+		if conn, err = net.Dial("udp", addr); err != nil {
+			return
+		}
+		return &udpClientConn{Conn: conn, maxSize: maxDatagramSize}, nil
+	}
+}
+
+type udpClientConn struct {
+	net.Conn
+	maxSize int
+	buf     []byte
+}
+
+func (c *udpClientConn) ReadPacket() (pkt []byte, err error) {
+	if c.buf == nil {
+		c.buf = make([]byte, c.maxSize+1)
+	}
+
+	var n int
+	for {
+		if n, err = c.Conn.Read(c.buf); err != nil {
+			return
+		}
+		if n <= c.maxSize {
+			pkt = make([]byte, n)
+			copy(pkt, c.buf[:n])
+			return pkt, nil
+		}
+	}
+}
+
+func (c *udpClientConn) Write(b []byte) (n int, err error) {
+	if len(b) > c.maxSize {
+		return 0, ErrDatagramTooLarge
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *udpClientConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,99 @@
+package knet
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPListenerAcceptBacklog(t *testing.T) {
+	ln, err := UDPListenFunc(0, 0)("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("udp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	first := dial()
+	first.Write([]byte("hello"))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := conn.(packetReader)
+	if pkt, err := pc.ReadPacket(); err != nil || string(pkt) != "hello" {
+		t.Fatalf("ReadPacket() = %q, %v", pkt, err)
+	}
+
+	// new peers nobody accepts must not stall the established one
+	for i := 0; i < cap(ln.(*udpListener).acceptCh)+16; i++ {
+		dial().Write([]byte("x"))
+	}
+
+	first.Write([]byte("again"))
+
+	done := make(chan []byte, 1)
+	go func() {
+		pkt, _ := pc.ReadPacket()
+		done <- pkt
+	}()
+
+	select {
+	case pkt := <-done:
+		if string(pkt) != "again" {
+			t.Fatalf("ReadPacket() = %q, want again", pkt)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("datagram of an accepted peer stalled by the accept backlog")
+	}
+}
+
+func TestUDPClientConnReadPacketCopies(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	conn, err := UDPDialFunc(0)(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+
+	buf := make([]byte, 16)
+	_, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.WriteTo([]byte("first"), addr)
+	pc.WriteTo([]byte("second"), addr)
+
+	r := conn.(packetReader)
+	first, err := r.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(first) != "first" || string(second) != "second" {
+		t.Fatalf("packets = %q, %q", first, second)
+	}
+	if cap(first) != len(first) {
+		t.Fatalf("packet holds %d bytes for a %d bytes datagram", cap(first), len(first))
+	}
+}
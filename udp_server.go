@@ -0,0 +1,48 @@
+package knet
+
+import (
+	"context"
+	"time"
+)
+
+type UDPServerConfig struct {
+	Io struct {
+		SendQueueSize int
+		RecvQueueSize int
+		ReadTimeout   time.Duration
+		WriteTimeout  time.Duration
+	}
+	MaxConnection   int
+	Overload        *OverloadConfig
+	RateLimit       *RateLimitConfig
+	AccessControl   *AccessControl
+	MaxDatagramSize int
+	IdleTimeout     time.Duration
+}
+
+func NewUDPServerConfig() *UDPServerConfig {
+	conf := &UDPServerConfig{}
+	conf.Io.SendQueueSize = 16
+	conf.Io.RecvQueueSize = 16
+	conf.MaxDatagramSize = MaxUDPDatagramSize
+	conf.IdleTimeout = time.Minute
+	return conf
+}
+
+type UDPServer struct {
+	*ServerBase
+}
+
+func NewUDPServer(ctx context.Context, conf *UDPServerConfig) *UDPServer {
+	srvConf := &ServerConfig{}
+	srvConf.Io = conf.Io
+	srvConf.MaxConnection = conf.MaxConnection
+	srvConf.Overload = conf.Overload
+	srvConf.RateLimit = conf.RateLimit
+	srvConf.AccessControl = conf.AccessControl
+
+	srv := &UDPServer{
+		ServerBase: NewServerBase(ctx, UDPListenFunc(conf.MaxDatagramSize, conf.IdleTimeout), srvConf),
+	}
+	return srv
+}
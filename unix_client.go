@@ -0,0 +1,42 @@
+package knet
+
+import (
+	"context"
+	"time"
+)
+
+type UnixClientConfig struct {
+	Io struct {
+		SendQueueSize int
+		RecvQueueSize int
+		ReadTimeout   time.Duration
+		WriteTimeout  time.Duration
+	}
+	DialTimeout   time.Duration
+	AutoReconnect bool
+	MaxInFlight   int
+}
+
+func NewUnixClientConfig() *UnixClientConfig {
+	conf := &UnixClientConfig{}
+	conf.Io.SendQueueSize = 16
+	conf.Io.RecvQueueSize = 16
+	conf.DialTimeout = 30 * time.Second
+	return conf
+}
+
+type UnixClient struct {
+	*ClientBase
+}
+
+func NewUnixClient(ctx context.Context, conf *UnixClientConfig) *UnixClient {
+	clientConf := &ClientConfig{}
+	clientConf.Io = conf.Io
+	clientConf.AutoReconnect = conf.AutoReconnect
+	clientConf.MaxInFlight = conf.MaxInFlight
+
+	c := &UnixClient{
+		ClientBase: NewClientBase(ctx, UnixDialFunc(conf.DialTimeout), clientConf),
+	}
+	return c
+}
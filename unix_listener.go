@@ -0,0 +1,113 @@
+package knet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+var ErrPeerCredNotSupported = errors.New("peer credentials not supported")
+
+// PeerCred is the identity of the process on the other end of a unix socket.
+type PeerCred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+// UnixListenFunc returns a ListenFunc for unix stream sockets. A stale socket
+// file left behind by a dead process is removed before listening. mode, uid
+// and gid are applied to the socket file, mode 0 and negative ids are ignored.
+//
+// On Linux the socket is bound accessible to its owner only and opened up to
+// mode once its owner is set, so it is never reachable with wider
+// permissions. Listening fails if another process bound addr meanwhile.
+func UnixListenFunc(mode os.FileMode, uid, gid int) ListenFunc {
+	return func(addr string) (ln net.Listener, err error) {
+		if isAbstractSocket(addr) {
+			return net.Listen("unix", addr)
+		}
+
+		if err = removeStaleSocket(addr); err != nil {
+			return
+		}
+
+		var lc net.ListenConfig
+		if mode != 0 {
+			lc.Control = restrictSocketMode
+		}
+		if ln, err = lc.Listen(context.Background(), "unix", addr); err != nil {
+			return
+		}
+
+		if err = setSocketOwner(addr, mode, uid, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return
+	}
+}
+
+// setSocketOwner changes the owner first, the mode may grant access to the
+// group being set.
+func setSocketOwner(path string, mode os.FileMode, uid, gid int) error {
+	if uid >= 0 || gid >= 0 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if mode != 0 {
+		return os.Chmod(path, mode)
+	}
+	return nil
+}
+
+func UnixDialFunc(timeout time.Duration) DialFunc {
+	return func(addr string) (conn net.Conn, err error) {
+		if timeout > 0 {
+			return net.DialTimeout("unix", addr, timeout)
+		}
+		return net.Dial("unix", addr)
+	}
+}
+
+func isAbstractSocket(addr string) bool {
+	return len(addr) > 0 && addr[0] == '@'
+}
+
+func removeStaleSocket(addr string) error {
+	if isAbstractSocket(addr) {
+		return nil
+	}
+
+	fi, err := os.Lstat(addr)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", addr)
+	}
+
+	conn, err := net.DialTimeout("unix", addr, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", addr)
+	}
+	return os.Remove(addr)
+}
+
+func unixConnOf(c net.Conn) *net.UnixConn {
+	uc, _ := unwrapConn(c, func(c net.Conn) bool {
+		_, ok := c.(*net.UnixConn)
+		return ok
+	}).(*net.UnixConn)
+	return uc
+}
@@ -0,0 +1,167 @@
+package knet
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnixListenFuncMode(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "test.sock")
+
+	ln, err := UnixListenFunc(0600, -1, -1)(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("%s is not a socket", addr)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("mode = %v, want 0600", perm)
+	}
+	if got := ln.Addr().String(); got != addr {
+		t.Fatalf("Addr() = %v, want %v", got, addr)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(addr))
+	if len(entries) != 1 {
+		t.Fatalf("bind directory left behind: %v", entries)
+	}
+
+	ln.Close()
+	if _, err = os.Stat(addr); !os.IsNotExist(err) {
+		t.Fatalf("socket not removed on close: %v", err)
+	}
+}
+
+func TestUnixServerZeroConfig(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "test.sock")
+
+	srv := NewUnixServer(testContext(t), &UnixServerConfig{})
+	ln, err := srv.listen(addr)
+	if err != nil {
+		t.Fatalf("listen with a zero config: %v", err)
+	}
+	ln.Close()
+}
+
+func TestUnixListenFuncStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	listen := UnixListenFunc(0600, -1, -1)
+
+	// a socket file left behind by a dead server is replaced
+	stale := filepath.Join(dir, "stale.sock")
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ul.SetUnlinkOnClose(false)
+	ul.Close()
+
+	ln, err := listen(stale)
+	if err != nil {
+		t.Fatalf("listen on a stale socket: %v", err)
+	}
+	defer ln.Close()
+
+	// a live socket is not
+	if _, err = listen(stale); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("listen on a live socket error = %v, want in use", err)
+	}
+
+	// nor is anything else
+	file := filepath.Join(dir, "file")
+	if err = os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = listen(file); err == nil {
+		t.Fatal("listen on a regular file succeeded")
+	}
+	if _, err = os.Stat(file); err != nil {
+		t.Fatalf("regular file removed: %v", err)
+	}
+}
+
+func TestUnixListenFuncWideMode(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "test.sock")
+
+	// wider than the owner only bind, and than the usual umask
+	ln, err := UnixListenFunc(0666, -1, -1)(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	fi, err := os.Stat(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0666 {
+		t.Fatalf("mode = %v, want 0666", perm)
+	}
+}
+
+func TestUnixSessionPeerCred(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "test.sock")
+
+	type result struct {
+		cred *PeerCred
+		err  error
+	}
+	results := make(chan result, 1)
+	h := newRecordHandler()
+	h.onConnected = func(s *IoSession) error {
+		cred, err := s.PeerCred()
+		results <- result{cred, err}
+		return nil
+	}
+
+	srv := NewUnixServer(testContext(t), NewUnixServerConfig())
+	srv.SetProtocol(testProto{})
+	srv.SetIoHandler(h)
+
+	ln, err := srv.listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		srv.Serve(ln)
+		close(served)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-served
+		srv.Close()
+	})
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case r := <-results:
+		if runtime.GOOS != "linux" {
+			if r.err != ErrPeerCredNotSupported {
+				t.Fatalf("PeerCred() error = %v, want %v", r.err, ErrPeerCredNotSupported)
+			}
+			return
+		}
+		if cred := r.cred; r.err != nil || int(cred.Pid) != os.Getpid() || int(cred.Uid) != os.Getuid() || int(cred.Gid) != os.Getgid() {
+			t.Fatalf("PeerCred() = %+v, %v, want pid %d, uid %d, gid %d", cred, r.err, os.Getpid(), os.Getuid(), os.Getgid())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("session not opened")
+	}
+}
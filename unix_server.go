@@ -0,0 +1,62 @@
+package knet
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+type UnixServerConfig struct {
+	Io struct {
+		SendQueueSize int
+		RecvQueueSize int
+		ReadTimeout   time.Duration
+		WriteTimeout  time.Duration
+	}
+	Overload      *OverloadConfig
+	RateLimit     *RateLimitConfig
+	AccessControl *AccessControl
+	MaxConnection int
+	SocketMode    os.FileMode
+	// SocketOwner changes the owner of the socket file, nil leaves it
+	// owned by the process.
+	SocketOwner *SocketOwner
+}
+
+// SocketOwner is the owner of a unix socket file, a negative id is left
+// unchanged.
+type SocketOwner struct {
+	Uid int
+	Gid int
+}
+
+func NewUnixServerConfig() *UnixServerConfig {
+	conf := &UnixServerConfig{}
+	conf.Io.SendQueueSize = 16
+	conf.Io.RecvQueueSize = 16
+	conf.SocketMode = 0660
+	return conf
+}
+
+type UnixServer struct {
+	*ServerBase
+}
+
+func NewUnixServer(ctx context.Context, conf *UnixServerConfig) *UnixServer {
+	srvConf := &ServerConfig{}
+	srvConf.Io = conf.Io
+	srvConf.MaxConnection = conf.MaxConnection
+	srvConf.Overload = conf.Overload
+	srvConf.RateLimit = conf.RateLimit
+	srvConf.AccessControl = conf.AccessControl
+
+	uid, gid := -1, -1
+	if conf.SocketOwner != nil {
+		uid, gid = conf.SocketOwner.Uid, conf.SocketOwner.Gid
+	}
+
+	srv := &UnixServer{
+		ServerBase: NewServerBase(ctx, UnixListenFunc(conf.SocketMode, uid, gid), srvConf),
+	}
+	return srv
+}
@@ -0,0 +1,503 @@
+package knet
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	WSCloseNormal          = 1000
+	WSCloseGoingAway       = 1001
+	WSCloseProtocolError   = 1002
+	WSCloseUnsupportedData = 1003
+	WSCloseNoStatus        = 1005
+	WSCloseMessageTooBig   = 1009
+	WSCloseInternalError   = 1011
+)
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// DefaultWSMaxMessageSize is the message size limit applied when none is
+// configured.
+const DefaultWSMaxMessageSize = 1 << 20
+
+var (
+	ErrWSMessageTooLarge = errors.New("websocket message too large")
+	ErrWSProtocol        = errors.New("websocket protocol error")
+	ErrWSBadHandshake    = errors.New("websocket bad handshake")
+)
+
+// WSCloseError is returned by reads after the peer closed the websocket
+// with a status other than normal closure.
+type WSCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *WSCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: code=%d, reason=%s", e.Code, e.Reason)
+}
+
+type wsFrameHeader struct {
+	fin     bool
+	opcode  byte
+	masked  bool
+	maskKey [4]byte
+	length  int64
+}
+
+// WSConn presents a websocket connection as a byte stream: reads return the
+// payload of binary messages in order and every Write is sent as one binary
+// message. Ping, pong and close frames are handled transparently.
+type WSConn struct {
+	net.Conn
+	br             *bufio.Reader
+	isClient       bool
+	maxMessageSize int64
+
+	readLock   sync.Mutex
+	remaining  int64
+	msgSize    int64
+	maskKey    [4]byte
+	maskPos    int
+	masked     bool
+	inMessage  bool
+	finalFrame bool
+	// partial holds the fragments read by a ReadMessage which timed out
+	// before the final one
+	partial    []byte
+	readErr    error
+	closeCode  int
+	closeError string
+
+	writeLock sync.Mutex
+	closeSent bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWSConn(conn net.Conn, br *bufio.Reader, isClient bool, maxMessageSize int64, pingInterval time.Duration) *WSConn {
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultWSMaxMessageSize
+	}
+
+	c := &WSConn{
+		Conn:           conn,
+		br:             br,
+		isClient:       isClient,
+		maxMessageSize: maxMessageSize,
+		done:           make(chan struct{}),
+	}
+
+	if pingInterval > 0 {
+		go c.pingLoop(pingInterval)
+	}
+	return c
+}
+
+func (c *WSConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseCode returns the status code sent by the peer in its close frame,
+// or 0 if no close frame has been received.
+func (c *WSConn) CloseCode() (code int, reason string) {
+	c.readLock.Lock()
+	code, reason = c.closeCode, c.closeError
+	c.readLock.Unlock()
+	return
+}
+
+func (c *WSConn) Read(b []byte) (n int, err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for c.remaining == 0 {
+		if err = c.nextDataFrame(); err != nil {
+			return
+		}
+	}
+
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+
+	if n, err = c.br.Read(b); err != nil {
+		return
+	}
+	c.unmask(b[:n])
+	c.remaining -= int64(n)
+	return
+}
+
+// ReadMessage reads one whole data message.
+func (c *WSConn) ReadMessage() (msg []byte, err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if msg, c.partial = c.partial, nil; msg == nil {
+		msg = []byte{}
+	}
+	for {
+		if err = c.nextDataFrame(); err != nil {
+			// resume the message on the next call if the read can be retried
+			if c.readErr == nil {
+				c.partial = msg
+			}
+			return nil, err
+		}
+
+		buf := make([]byte, c.remaining)
+		if _, err = io.ReadFull(c.br, buf); err != nil {
+			// the part of the frame already read is lost
+			c.readErr = err
+			return nil, err
+		}
+		c.unmask(buf)
+		c.remaining = 0
+		msg = append(msg, buf...)
+
+		if c.finalFrame {
+			return
+		}
+	}
+}
+
+func (c *WSConn) Write(b []byte) (n int, err error) {
+	if err = c.writeFrame(wsOpBinary, b); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (c *WSConn) Ping(data []byte) error {
+	return c.writeFrame(wsOpPing, data)
+}
+
+// CloseWithCode sends a close frame with the given status and closes the
+// underlying connection.
+func (c *WSConn) CloseWithCode(code int, reason string) error {
+	c.sendClose(code, reason)
+	return c.Close()
+}
+
+func (c *WSConn) Close() error {
+	c.sendClose(WSCloseNormal, "")
+
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *WSConn) pingLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.Ping(nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *WSConn) nextDataFrame() (err error) {
+	if c.readErr != nil {
+		return c.readErr
+	}
+
+	var started bool
+
+	defer func() {
+		// a read timing out before a frame started can be retried, anything
+		// else is fatal as the part of the frame already read is lost
+		if ne, ok := err.(net.Error); err != nil && (started || !ok || !ne.Timeout()) {
+			c.readErr = err
+		}
+	}()
+
+	for {
+		started = false
+		if _, err = c.br.Peek(1); err != nil {
+			return
+		}
+		started = true
+
+		var h wsFrameHeader
+		if h, err = c.readFrameHeader(); err != nil {
+			return
+		}
+
+		if h.opcode >= wsOpClose {
+			if err = c.handleControlFrame(h); err != nil {
+				return
+			}
+			continue
+		}
+
+		switch {
+		case h.opcode == wsOpContinuation && c.inMessage:
+		case (h.opcode == wsOpText || h.opcode == wsOpBinary) && !c.inMessage:
+			c.msgSize = 0
+		default:
+			c.failConnection(WSCloseProtocolError)
+			return ErrWSProtocol
+		}
+
+		if h.length > c.maxMessageSize-c.msgSize {
+			c.failConnection(WSCloseMessageTooBig)
+			return ErrWSMessageTooLarge
+		}
+		c.msgSize += h.length
+
+		c.inMessage = !h.fin
+		c.finalFrame = h.fin
+		c.remaining = h.length
+		c.masked = h.masked
+		c.maskKey = h.maskKey
+		c.maskPos = 0
+		return nil
+	}
+}
+
+func (c *WSConn) handleControlFrame(h wsFrameHeader) (err error) {
+	if !h.fin || h.length > 125 {
+		c.failConnection(WSCloseProtocolError)
+		return ErrWSProtocol
+	}
+
+	payload := make([]byte, h.length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	if h.masked {
+		maskBytes(h.maskKey, 0, payload)
+	}
+
+	switch h.opcode {
+	case wsOpPing:
+		return c.writeFrame(wsOpPong, payload)
+	case wsOpPong:
+		return nil
+	case wsOpClose:
+		code, reason := WSCloseNoStatus, ""
+		switch {
+		case len(payload) == 1:
+			c.failConnection(WSCloseProtocolError)
+			return ErrWSProtocol
+		case len(payload) >= 2:
+			code = int(binary.BigEndian.Uint16(payload))
+			reason = string(payload[2:])
+			if !validCloseCode(code) {
+				c.failConnection(WSCloseProtocolError)
+				return ErrWSProtocol
+			}
+		}
+		c.closeCode, c.closeError = code, reason
+		c.sendClose(code, "")
+
+		if code == WSCloseNormal || code == WSCloseGoingAway || code == WSCloseNoStatus {
+			return io.EOF
+		}
+		return &WSCloseError{Code: code, Reason: reason}
+	default:
+		c.failConnection(WSCloseProtocolError)
+		return ErrWSProtocol
+	}
+}
+
+// validCloseCode tells whether code may be sent in a close frame, the
+// codes reserved for the status of the connection itself may not.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code < 1000 || code > 1014:
+		return false
+	}
+	return code != 1004 && code != WSCloseNoStatus && code != 1006
+}
+
+func (c *WSConn) readFrameHeader() (h wsFrameHeader, err error) {
+	var b [8]byte
+
+	if _, err = io.ReadFull(c.br, b[:2]); err != nil {
+		return
+	}
+
+	h.fin = b[0]&0x80 != 0
+	h.opcode = b[0] & 0x0f
+	h.masked = b[1]&0x80 != 0
+
+	if b[0]&0x70 != 0 || h.masked == c.isClient {
+		c.failConnection(WSCloseProtocolError)
+		return h, ErrWSProtocol
+	}
+
+	switch n := b[1] & 0x7f; n {
+	case 126:
+		if _, err = io.ReadFull(c.br, b[:2]); err != nil {
+			return
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err = io.ReadFull(c.br, b[:8]); err != nil {
+			return
+		}
+		h.length = int64(binary.BigEndian.Uint64(b[:8]))
+		if h.length < 0 {
+			c.failConnection(WSCloseProtocolError)
+			return h, ErrWSProtocol
+		}
+	default:
+		h.length = int64(n)
+	}
+
+	if h.masked {
+		if _, err = io.ReadFull(c.br, h.maskKey[:]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *WSConn) unmask(b []byte) {
+	if c.masked {
+		c.maskPos = maskBytes(c.maskKey, c.maskPos, b)
+	}
+}
+
+func (c *WSConn) failConnection(code int) {
+	c.sendClose(code, "")
+}
+
+func (c *WSConn) sendClose(code int, reason string) {
+	c.writeLock.Lock()
+	sent := c.closeSent
+	c.closeSent = true
+	c.writeLock.Unlock()
+
+	if sent {
+		return
+	}
+
+	// never let an unresponsive peer block the close
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+
+	// no status is told with an empty close frame, 1005 is never sent
+	var payload []byte
+	if code != WSCloseNoStatus {
+		payload = make([]byte, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		copy(payload[2:], reason)
+	}
+	_ = c.writeFrameLocked(wsOpClose, payload, true)
+}
+
+func (c *WSConn) writeFrame(opcode byte, payload []byte) error {
+	return c.writeFrameLocked(opcode, payload, false)
+}
+
+func (c *WSConn) writeFrameLocked(opcode byte, payload []byte, closing bool) (err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.closeSent && !closing {
+		return net.ErrClosed
+	}
+
+	var (
+		header [14]byte
+		n      = 2
+		length = len(payload)
+	)
+
+	header[0] = 0x80 | opcode
+
+	switch {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+		n += 2
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+		n += 8
+	}
+
+	frame := make([]byte, 0, n+4+length)
+
+	if c.isClient {
+		var key [4]byte
+		if _, err = rand.Read(key[:]); err != nil {
+			return
+		}
+		header[1] |= 0x80
+		frame = append(frame, header[:n]...)
+		frame = append(frame, key[:]...)
+		frame = append(frame, payload...)
+		maskBytes(key, 0, frame[n+4:])
+	} else {
+		frame = append(frame, header[:n]...)
+		frame = append(frame, payload...)
+	}
+
+	_, err = c.Conn.Write(frame)
+	return
+}
+
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[pos&3]
+		pos++
+	}
+	return pos & 3
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// wsMessageConn delivers one websocket message per Decode.
+type wsMessageConn struct {
+	*WSConn
+}
+
+func (c *wsMessageConn) ReadPacket() ([]byte, error) {
+	return c.ReadMessage()
+}
+
+func (c *wsMessageConn) NetConn() net.Conn {
+	return c.WSConn
+}
@@ -0,0 +1,173 @@
+package knet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// maskedFrame builds a final binary frame as sent by a client.
+func maskedFrame(payload []byte) []byte {
+	return maskedFrameOp(wsOpBinary, true, payload)
+}
+
+// maskedFrameOp builds a frame of opcode as sent by a client.
+func maskedFrameOp(opcode byte, fin bool, payload []byte) []byte {
+	key := [4]byte{1, 2, 3, 4}
+	if fin {
+		opcode |= 0x80
+	}
+	frame := []byte{opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, key[:]...)
+	frame = append(frame, payload...)
+	maskBytes(key, 0, frame[6:])
+	return frame
+}
+
+func newTestWSConn(t *testing.T, maxMessageSize int64) (*WSConn, net.Conn) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	// swallow what the server writes, such as close frames
+	go io.Copy(io.Discard, client)
+
+	return newWSConn(server, bufio.NewReader(server), false, maxMessageSize, 0), client
+}
+
+func TestWSConnIdleTimeoutRetryable(t *testing.T) {
+	c, client := newTestWSConn(t, 0)
+
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 16)
+	if _, err := c.Read(buf); !isTimeout(err) {
+		t.Fatalf("Read() error = %v, want a timeout", err)
+	}
+
+	go client.Write(maskedFrame([]byte("hello")))
+
+	c.SetReadDeadline(time.Time{})
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read() = %q, %v, want hello", buf[:n], err)
+	}
+}
+
+func TestWSConnPartialFrameTimeoutFatal(t *testing.T) {
+	c, client := newTestWSConn(t, 0)
+
+	frame := maskedFrame([]byte("hello"))
+	go client.Write(frame[:3])
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 16)
+	if _, err := c.Read(buf); !isTimeout(err) {
+		t.Fatalf("Read() error = %v, want a timeout", err)
+	}
+
+	go client.Write(frame[3:])
+
+	// the rest of the frame must not be parsed as a new one
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := c.Read(buf); !isTimeout(err) {
+		t.Fatalf("Read() = %q, %v after a partial frame, want the timeout again", buf[:n], err)
+	}
+}
+
+func TestWSConnDefaultMaxMessageSize(t *testing.T) {
+	c, client := newTestWSConn(t, 0)
+
+	// header of a masked frame announcing a payload past the default limit
+	header := []byte{0x82, 0x80 | 127, 0, 0, 0, 0, 0x10, 0, 0, 0, 1, 2, 3, 4}
+	go client.Write(header)
+
+	if _, err := c.ReadMessage(); !errors.Is(err, ErrWSMessageTooLarge) {
+		t.Fatalf("ReadMessage() error = %v, want %v", err, ErrWSMessageTooLarge)
+	}
+}
+
+func TestWSConnFragmentTimeoutResumes(t *testing.T) {
+	c, client := newTestWSConn(t, 0)
+
+	go client.Write(maskedFrameOp(wsOpBinary, false, []byte("hel")))
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.ReadMessage(); !isTimeout(err) {
+		t.Fatalf("ReadMessage() error = %v, want a timeout", err)
+	}
+
+	go client.Write(maskedFrameOp(wsOpContinuation, true, []byte("lo")))
+
+	// the fragments read before the timeout are not lost
+	c.SetReadDeadline(time.Time{})
+	msg, err := c.ReadMessage()
+	if err != nil || string(msg) != "hello" {
+		t.Fatalf("ReadMessage() = %q, %v, want hello", msg, err)
+	}
+}
+
+// readCloseReply sends the close frame payload to a server side WSConn and
+// returns the payload of the close frame it replies with.
+func readCloseReply(t *testing.T, payload []byte) (reply []byte) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	c := newWSConn(server, bufio.NewReader(server), false, 0, 0)
+
+	go client.Write(maskedFrameOp(wsOpClose, true, payload))
+	go c.ReadMessage()
+
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	br := bufio.NewReader(client)
+	var h [2]byte
+	if _, err := io.ReadFull(br, h[:]); err != nil {
+		t.Fatal(err)
+	}
+	if h[0] != 0x80|wsOpClose {
+		t.Fatalf("reply frame %#x, want a close frame", h[0])
+	}
+	reply = make([]byte, h[1]&0x7f)
+	if _, err := io.ReadFull(br, reply); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestWSConnCloseReply(t *testing.T) {
+	status := func(code int) []byte {
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(code))
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		reply   []byte
+	}{
+		{name: "no status", payload: nil, reply: []byte{}},
+		{name: "normal", payload: status(WSCloseNormal), reply: status(WSCloseNormal)},
+		{name: "application", payload: status(4000), reply: status(4000)},
+		{name: "one byte", payload: []byte{3}, reply: status(WSCloseProtocolError)},
+		{name: "below 1000", payload: status(999), reply: status(WSCloseProtocolError)},
+		{name: "no status code", payload: status(WSCloseNoStatus), reply: status(WSCloseProtocolError)},
+		{name: "abnormal", payload: status(1006), reply: status(WSCloseProtocolError)},
+		{name: "tls", payload: status(1015), reply: status(WSCloseProtocolError)},
+	}
+
+	for _, tt := range tests {
+		reply := readCloseReply(t, tt.payload)
+		if !bytes.Equal(reply, tt.reply) {
+			t.Errorf("%s: close reply %v, want %v", tt.name, reply, tt.reply)
+		}
+	}
+}
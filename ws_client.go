@@ -0,0 +1,46 @@
+package knet
+
+import (
+	"context"
+	"time"
+)
+
+type WSClientConfig struct {
+	Io struct {
+		SendQueueSize int
+		RecvQueueSize int
+		ReadTimeout   time.Duration
+		WriteTimeout  time.Duration
+	}
+	DialTimeout   time.Duration
+	AutoReconnect bool
+	MaxInFlight   int
+	WS            WSConfig
+}
+
+func NewWSClientConfig() *WSClientConfig {
+	conf := &WSClientConfig{}
+	conf.Io.SendQueueSize = 16
+	conf.Io.RecvQueueSize = 16
+	conf.DialTimeout = 30 * time.Second
+	conf.WS = *NewWSConfig()
+	return conf
+}
+
+type WSClient struct {
+	*ClientBase
+}
+
+func NewWSClient(ctx context.Context, conf *WSClientConfig) *WSClient {
+	clientConf := &ClientConfig{}
+	clientConf.Io = conf.Io
+	clientConf.AutoReconnect = conf.AutoReconnect
+	clientConf.MaxInFlight = conf.MaxInFlight
+
+	wsConf := conf.WS
+
+	c := &WSClient{
+		ClientBase: NewClientBase(ctx, WSDialFunc(conf.DialTimeout, &wsConf), clientConf),
+	}
+	return c
+}
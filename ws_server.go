@@ -0,0 +1,53 @@
+package knet
+
+import (
+	"context"
+	"time"
+)
+
+type WSServerConfig struct {
+	Io struct {
+		SendQueueSize int
+		RecvQueueSize int
+		ReadTimeout   time.Duration
+		WriteTimeout  time.Duration
+	}
+	Overload      *OverloadConfig
+	RateLimit     *RateLimitConfig
+	AccessControl *AccessControl
+	MaxConnection int
+	WS            WSConfig
+}
+
+func NewWSServerConfig() *WSServerConfig {
+	conf := &WSServerConfig{}
+	conf.Io.SendQueueSize = 16
+	conf.Io.RecvQueueSize = 16
+	conf.WS = *NewWSConfig()
+	return conf
+}
+
+type WSServer struct {
+	*ServerBase
+}
+
+func NewWSServer(ctx context.Context, conf *WSServerConfig) *WSServer {
+	srvConf := &ServerConfig{}
+	srvConf.Io = conf.Io
+	srvConf.MaxConnection = conf.MaxConnection
+	srvConf.Overload = conf.Overload
+	srvConf.RateLimit = conf.RateLimit
+	srvConf.AccessControl = conf.AccessControl
+
+	wsConf := conf.WS
+
+	srv := &WSServer{
+		ServerBase: NewServerBase(ctx, WSListenFunc(&wsConf), srvConf),
+	}
+
+	// refuse connections in the listener, before spending a handshake
+	if conf.AccessControl != nil {
+		wsConf.allow = srv.allowed
+	}
+	return srv
+}
@@ -0,0 +1,88 @@
+package knet
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func startWSServer(t *testing.T, conf *WSServerConfig) (*WSServer, string) {
+	t.Helper()
+
+	srv := NewWSServer(testContext(t), conf)
+	srv.SetProtocol(testProto{})
+	srv.SetIoHandler(&echoHandler{})
+
+	ln, err := srv.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan struct{})
+	go func() {
+		srv.Serve(ln)
+		close(served)
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-served
+		srv.Close()
+	})
+	return srv, ln.Addr().String()
+}
+
+const wsUpgradeRequest = "GET / HTTP/1.1\r\nHost: knet\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+	"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+
+func TestWSServerAccessDenied(t *testing.T) {
+	ac := NewAccessControl()
+	if err := ac.SetDenyCIDRs("127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := NewWSServerConfig()
+	conf.AccessControl = ac
+	srv, addr := startWSServer(t, conf)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, wsUpgradeRequest)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	// closed without a handshake response
+	if n, err := conn.Read(make([]byte, 64)); n != 0 || err != io.EOF {
+		t.Fatalf("Read() = %d, %v, want the connection closed unanswered", n, err)
+	}
+	if n := srv.Stats().Denied; n != 1 {
+		t.Fatalf("%d connections denied, want 1", n)
+	}
+}
+
+func TestWSServerAccessAllowed(t *testing.T) {
+	ac := NewAccessControl()
+	if err := ac.SetAllowCIDRs("127.0.0.1/32"); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := NewWSServerConfig()
+	conf.AccessControl = ac
+	_, addr := startWSServer(t, conf)
+
+	c := NewWSClient(testContext(t), NewWSClientConfig())
+	c.SetProtocol(testProto{})
+	if err := c.Dial("ws://" + addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	resp, err := c.CallWithTimeout(context.Background(), &testMsg{id: 1, body: "hello"}, time.Second)
+	if err != nil || resp.(*testMsg).body != "hello" {
+		t.Fatalf("CallWithTimeout() = %v, %v", resp, err)
+	}
+}
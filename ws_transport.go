@@ -0,0 +1,328 @@
+package knet
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type WSConfig struct {
+	// Path is the request path served by the listener, any path if empty.
+	Path             string
+	Header           http.Header
+	CheckOrigin      func(r *http.Request) bool
+	TLSConfig        *tls.Config
+	HandshakeTimeout time.Duration
+	PingInterval     time.Duration
+	// MaxMessageSize limits the size of a message, 0 means
+	// DefaultWSMaxMessageSize.
+	MaxMessageSize int64
+	// MessageMode makes every websocket message one Decode unit instead of
+	// presenting the connection as a continuous byte stream.
+	MessageMode bool
+
+	// allow, set by WSServer, refuses connections before their handshake
+	allow func(conn net.Conn) bool
+}
+
+func NewWSConfig() *WSConfig {
+	return &WSConfig{
+		HandshakeTimeout: 10 * time.Second,
+		MaxMessageSize:   DefaultWSMaxMessageSize,
+	}
+}
+
+func (conf *WSConfig) wrap(c *WSConn) net.Conn {
+	if conf.MessageMode {
+		return &wsMessageConn{c}
+	}
+	return c
+}
+
+// WSListenFunc returns a ListenFunc accepting websocket connections. The
+// opening handshakes run concurrently so a slow client can't stall Accept.
+func WSListenFunc(conf *WSConfig) ListenFunc {
+	return func(addr string) (ln net.Listener, err error) {
+		if ln, err = TCPListen(addr); err != nil {
+			return
+		}
+		if conf.TLSConfig != nil {
+			ln = tls.NewListener(ln, conf.TLSConfig)
+		}
+		return WSListener(ln, conf), nil
+	}
+}
+
+// WSListener turns every connection accepted from l into a websocket
+// connection after a successful opening handshake.
+func WSListener(l net.Listener, conf *WSConfig) net.Listener {
+	wl := &wsListener{
+		Listener: l,
+		conf:     conf,
+		connCh:   make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go wl.acceptLoop()
+	return wl
+}
+
+type wsListener struct {
+	net.Listener
+	conf      *WSConfig
+	connCh    chan net.Conn
+	err       error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connCh:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *wsListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() {
+		if l.err == nil {
+			l.err = net.ErrClosed
+		}
+		close(l.done)
+	})
+	return err
+}
+
+func (l *wsListener) acceptLoop() {
+	var tempDelay time.Duration
+
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+
+			l.closeOnce.Do(func() {
+				l.err = err
+				close(l.done)
+			})
+			return
+		}
+
+		tempDelay = 0
+
+		if l.conf.allow != nil && !l.conf.allow(conn) {
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *wsListener) handshake(conn net.Conn) {
+	if l.conf.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(l.conf.HandshakeTimeout))
+	}
+
+	br := bufio.NewReader(conn)
+
+	if err := l.upgrade(conn, br); err != nil {
+		defaultLogger.Warn("websocket handshake failed", "remote_addr", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	c := newWSConn(conn, br, false, l.conf.MaxMessageSize, l.conf.PingInterval)
+
+	select {
+	case l.connCh <- l.conf.wrap(c):
+	case <-l.done:
+		c.CloseWithCode(WSCloseGoingAway, "")
+	}
+}
+
+func (l *wsListener) upgrade(conn net.Conn, br *bufio.Reader) (err error) {
+	var req *http.Request
+
+	if req, err = http.ReadRequest(br); err != nil {
+		return
+	}
+
+	reject := func(status int, reason string) error {
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+		return fmt.Errorf("%w: %s", ErrWSBadHandshake, reason)
+	}
+
+	switch {
+	case req.Method != http.MethodGet:
+		return reject(http.StatusMethodNotAllowed, "method not GET")
+	case l.conf.Path != "" && req.URL.Path != l.conf.Path:
+		return reject(http.StatusNotFound, "path not found")
+	case !headerContains(req.Header, "Connection", "upgrade"),
+		!headerContains(req.Header, "Upgrade", "websocket"):
+		return reject(http.StatusBadRequest, "not a websocket upgrade")
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		return reject(http.StatusUpgradeRequired, "unsupported version")
+	case l.conf.CheckOrigin != nil && !l.conf.CheckOrigin(req):
+		return reject(http.StatusForbidden, "origin not allowed")
+	}
+
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return reject(http.StatusBadRequest, "missing key")
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n"
+
+	for k, vs := range l.conf.Header {
+		for _, v := range vs {
+			resp += k + ": " + v + "\r\n"
+		}
+	}
+
+	_, err = conn.Write([]byte(resp + "\r\n"))
+	return
+}
+
+// WSDialFunc returns a DialFunc for websocket urls such as
+// "ws://host:port/path" or "wss://host:port/path".
+func WSDialFunc(timeout time.Duration, conf *WSConfig) DialFunc {
+	return func(addr string) (conn net.Conn, err error) {
+		var u *url.URL
+		if u, err = url.Parse(addr); err != nil {
+			return
+		}
+
+		host := u.Host
+		if u.Port() == "" {
+			if u.Scheme == "wss" {
+				host = net.JoinHostPort(u.Hostname(), "443")
+			} else {
+				host = net.JoinHostPort(u.Hostname(), "80")
+			}
+		}
+
+		switch u.Scheme {
+		case "ws":
+			conn, err = TCPDialFunc(timeout)(host)
+		case "wss":
+			tlsConf := conf.TLSConfig
+			if tlsConf == nil {
+				tlsConf = &tls.Config{}
+			}
+			conn, err = TLSDialFunc(timeout, tlsConf)(host)
+		default:
+			err = fmt.Errorf("%w: unsupported scheme %q", ErrWSBadHandshake, u.Scheme)
+		}
+		if err != nil {
+			return
+		}
+
+		var br *bufio.Reader
+		if br, err = wsClientHandshake(conn, u, conf); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return conf.wrap(newWSConn(conn, br, true, conf.MaxMessageSize, conf.PingInterval)), nil
+	}
+}
+
+func wsClientHandshake(conn net.Conn, u *url.URL, conf *WSConfig) (br *bufio.Reader, err error) {
+	if conf.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(conf.HandshakeTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	var nonce [16]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		return
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+
+	for k, vs := range conf.Header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err = req.Write(conn); err != nil {
+		return
+	}
+
+	br = bufio.NewReader(conn)
+
+	var resp *http.Response
+	if resp, err = http.ReadResponse(br, req); err != nil {
+		return
+	}
+
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		err = fmt.Errorf("%w: unexpected status %s", ErrWSBadHandshake, resp.Status)
+	case !headerContains(resp.Header, "Upgrade", "websocket"),
+		!headerContains(resp.Header, "Connection", "upgrade"):
+		err = fmt.Errorf("%w: missing upgrade headers", ErrWSBadHandshake)
+	case resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key):
+		err = fmt.Errorf("%w: bad accept key", ErrWSBadHandshake)
+	}
+	return
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func wsConnOf(c net.Conn) *WSConn {
+	wc, _ := unwrapConn(c, func(c net.Conn) bool {
+		_, ok := c.(*WSConn)
+		return ok
+	}).(*WSConn)
+	return wc
+}